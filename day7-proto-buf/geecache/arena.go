@@ -0,0 +1,68 @@
+package geecache
+
+// 几百万个小entry放在lru里，每个entry都是好几个堆对象，GC每一轮都要把它们全扫一遍。
+// arena把key和value都拷贝进几块大的[]byte里，索引是不含指针的map[uint64]uint64，GC几乎不用管它们。
+
+import "geecache/arena"
+
+// WithArenaStorage keeps the group's mainCache and hotCache entries in
+// large pre-allocated byte arenas (see package arena) instead of one heap
+// object per entry, which takes them off the garbage collector's hands.
+// A standalone Cache gets the same with WithCacheArena.
+//
+// It trades read speed for GC time: every Get hashes the key and copies
+// the value out of the arena, about 1.5 times slower than the default LRU
+// in BenchmarkCacheGet, so it pays off for caches with many entries only.
+// Eviction is approximately LRU. The entry overhead of WithMemoryLimit
+// does not apply: entries are counted with their arena headers.
+func WithArenaStorage() GroupOption {
+	return func(g *Group) {
+		g.mainCache.arena = true
+		g.hotCache.arena = true
+	}
+}
+
+// arenaStore is a store backed by an arena.Cache.
+type arenaStore struct {
+	c         *arena.Cache
+	onEvicted func(key string, value ByteView, expires int64)
+}
+
+func newArenaStore(maxBytes int64, onEvicted func(key string, value ByteView, expires int64)) *arenaStore {
+	s := &arenaStore{onEvicted: onEvicted}
+	s.c = arena.New(maxBytes, func(key string, value []byte, expires int64) {
+		onEvicted(key, ByteView{b: value}, expires)
+	})
+	return s
+}
+
+func (s *arenaStore) add(key string, value ByteView, expires int64) {
+	if !s.c.Add(key, value.bytes(), expires) {
+		// 比整个cache还大，放不进去；和lru一样当作立刻被淘汰。
+		s.onEvicted(key, value, expires)
+	}
+}
+
+func (s *arenaStore) get(key string) (ByteView, int64, bool) {
+	v, expires, ok := s.c.Get(key)
+	return ByteView{b: v}, expires, ok
+}
+
+func (s *arenaStore) peek(key string) (ByteView, int64, bool) {
+	v, expires, ok := s.c.Peek(key)
+	return ByteView{b: v}, expires, ok
+}
+
+func (s *arenaStore) remove(key string) {
+	// arena.Cache不报告Remove，这里自己报告。
+	if v, expires, ok := s.c.Peek(key); ok {
+		s.c.Remove(key)
+		s.onEvicted(key, ByteView{b: v}, expires)
+	}
+}
+
+func (s *arenaStore) removeOldest()         { s.c.RemoveOldest() }
+func (s *arenaStore) len() int              { return s.c.Len() }
+func (s *arenaStore) bytes() int64          { return s.c.Bytes() }
+func (s *arenaStore) keys() []string        { return s.c.Keys() }
+func (s *arenaStore) resize(maxBytes int64) { s.c.Resize(maxBytes) }
@@ -0,0 +1,374 @@
+// Package arena implements a cache that keeps its keys and values in a few
+// large byte segments instead of one heap object per entry, the way
+// bigcache and freecache do. The garbage collector only sees the segments
+// and an index map with no pointers in it, so the time it spends on the
+// cache no longer grows with the number of entries.
+//
+// Entries are appended to the current segment. When every segment is full
+// the oldest one is recycled: entries read since they were written get a
+// second chance and are moved to the front of the recycled segment, the
+// others are evicted. This approximates LRU at a fraction of its cost.
+// Segments are a fraction of the cache, but grow, fewer of them, when an
+// entry larger than a segment is added. An unbounded cache compacts its
+// segments that are mostly garbage instead of recycling them.
+//
+// The price is paid on reads: Get hashes the key, compares it with the
+// stored one and copies the value out, where an LRU of ByteViews returns
+// a reference. In geecache's BenchmarkCacheGet that makes a Get about 1.5
+// times slower (1.2µs against 0.8µs), which is worth it for caches with
+// many entries, whose GC cost is the bigger one, and not for small ones.
+//
+// Every entry carries an expiry time, which the cache stores for its
+// caller but does not interpret.
+package arena
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+)
+
+// entry layout: hash(key) | len(key) | len(value) | flags | expires | key | value.
+const (
+	headerSize = 8 + 4 + 4 + 1 + 8
+
+	flagAccessed = 1 << 0
+
+	// segments is how many segments a bounded cache is split into, unless
+	// that would make them larger than maxSegmentSize.
+	segments       = 8
+	maxSegmentSize = 16 << 20
+	// unboundedSegmentSize is the segment size of caches without maxBytes.
+	unboundedSegmentSize = 1 << 20
+)
+
+// Cache is an arena-backed cache. It is not safe for concurrent access.
+type Cache struct {
+	maxBytes int64
+	segSize  int
+	segs     [][]byte // len is the bytes written so far, cap is segSize
+	live     []int    // bytes of the live entries in each segment
+	cur      int      // segment new entries are appended to
+	seed     maphash.Seed
+	index    map[uint64]uint64 // hash(key) -> segment<<32 | offset，没有指针，GC不用扫描
+	nbytes   int64             // bytes of live entries, headers included
+	// OnEvicted, if set, is called for entries evicted to make room for new
+	// ones. Entries removed with Remove or replaced by Add are not reported.
+	OnEvicted func(key string, value []byte, expires int64)
+}
+
+// New creates a cache holding at most maxBytes bytes of entries, headers
+// included. A maxBytes of zero means no limit.
+func New(maxBytes int64, onEvicted func(key string, value []byte, expires int64)) *Cache {
+	if maxBytes <= 0 {
+		return newCache(maxBytes, unboundedSegmentSize, 1, onEvicted)
+	}
+	n := int64(segments)
+	size := (maxBytes + n - 1) / n
+	if size > maxSegmentSize {
+		size = maxSegmentSize
+		n = (maxBytes + size - 1) / size
+	}
+	return newCache(maxBytes, size, n, onEvicted)
+}
+
+func newCache(maxBytes, segSize, n int64, onEvicted func(key string, value []byte, expires int64)) *Cache {
+	return &Cache{
+		maxBytes:  maxBytes,
+		segSize:   int(segSize),
+		segs:      make([][]byte, n),
+		live:      make([]int, n),
+		seed:      maphash.MakeSeed(),
+		index:     make(map[uint64]uint64),
+		OnEvicted: onEvicted,
+	}
+}
+
+func location(seg, off int) uint64 {
+	return uint64(seg)<<32 | uint64(off)
+}
+
+// entry returns the segment and offset of the entry at loc, and its key
+// and value lengths.
+func (c *Cache) entry(loc uint64) (seg []byte, off, keyLen, valueLen int) {
+	seg = c.segs[loc>>32]
+	off = int(uint32(loc))
+	keyLen = int(binary.LittleEndian.Uint32(seg[off+8:]))
+	valueLen = int(binary.LittleEndian.Uint32(seg[off+12:]))
+	return
+}
+
+// lookup returns the location of key. Keys whose hashes collide replace
+// each other, so the stored key is compared too.
+func (c *Cache) lookup(key string) (h, loc uint64, ok bool) {
+	h = maphash.String(c.seed, key)
+	loc, ok = c.index[h]
+	if !ok {
+		return
+	}
+	if string(c.keyAt(loc)) != key {
+		return h, 0, false
+	}
+	return h, loc, true
+}
+
+// keyAt returns the key of the entry at loc.
+func (c *Cache) keyAt(loc uint64) []byte {
+	seg, off, keyLen, _ := c.entry(loc)
+	return seg[off+headerSize : off+headerSize+keyLen]
+}
+
+// Add adds a value to the cache, copying it into a segment. It returns
+// false, and drops any previous value of key, if the entry is larger than
+// maxBytes. Another key whose hash collides with key's is evicted.
+func (c *Cache) Add(key string, value []byte, expires int64) bool {
+	size := headerSize + len(key) + len(value)
+	if c.maxBytes > 0 {
+		if int64(size) > c.maxBytes {
+			c.Remove(key)
+			return false
+		}
+		if size > c.segSize {
+			c.regrow(size)
+		}
+	}
+	h := maphash.String(c.seed, key)
+	if loc, ok := c.index[h]; ok {
+		if string(c.keyAt(loc)) == key {
+			c.kill(h, loc) // 旧值直接作废
+		} else {
+			c.evict(h, loc) // hash冲突的另一个key被挤掉了，要报告
+		}
+	}
+
+	c.makeRoom(size)
+	seg := c.segs[c.cur]
+	off := len(seg)
+	seg = seg[:off+size]
+	binary.LittleEndian.PutUint64(seg[off:], h)
+	binary.LittleEndian.PutUint32(seg[off+8:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(seg[off+12:], uint32(len(value)))
+	seg[off+16] = 0
+	binary.LittleEndian.PutUint64(seg[off+17:], uint64(expires))
+	copy(seg[off+headerSize:], key)
+	copy(seg[off+headerSize+len(key):], value)
+	c.segs[c.cur] = seg
+
+	c.index[h] = location(c.cur, off)
+	c.live[c.cur] += size
+	c.nbytes += int64(size)
+	return true
+}
+
+// regrow rebuilds a bounded cache with fewer, larger segments, so that an
+// entry of size bytes fits in one.
+func (c *Cache) regrow(size int) {
+	n := max(c.maxBytes/int64(size), 1)
+	segSize := max((c.maxBytes+n-1)/n, int64(size))
+	c.rebuild(newCache(c.maxBytes, segSize, n, c.OnEvicted))
+}
+
+// makeRoom moves on to another segment until the current one has size
+// free bytes. A bounded cache recycles the next segment; an unbounded one
+// reclaims a segment that is mostly garbage, or adds one.
+func (c *Cache) makeRoom(size int) {
+	for {
+		if c.segs[c.cur] == nil {
+			c.segs[c.cur] = make([]byte, 0, max(c.segSize, size))
+		}
+		if seg := c.segs[c.cur]; cap(seg)-len(seg) >= size {
+			return
+		}
+		if c.maxBytes <= 0 {
+			c.cur = c.reclaim(size)
+			continue
+		}
+		c.cur = (c.cur + 1) % len(c.segs)
+		c.recycle(c.cur)
+	}
+}
+
+// reclaim returns a segment of an unbounded cache that is at least half
+// garbage and has room for size bytes once compacted, compacting it, or a
+// new segment if there is none.
+func (c *Cache) reclaim(size int) int {
+	for i, seg := range c.segs {
+		if len(seg) > 0 && c.live[i] <= len(seg)/2 && cap(seg)-c.live[i] >= size {
+			c.sweep(i, func(entry []byte, w int) bool { return true })
+			return i
+		}
+	}
+	c.segs = append(c.segs, nil)
+	c.live = append(c.live, 0)
+	return len(c.segs) - 1
+}
+
+// recycle empties segment i for reuse. Live entries read since they were
+// written are moved to its front, as long as they take at most half of it
+// so that recycling always frees room; the others are evicted.
+func (c *Cache) recycle(i int) {
+	half := len(c.segs[i]) / 2
+	c.sweep(i, func(entry []byte, w int) bool {
+		if entry[16]&flagAccessed != 0 && w+len(entry) <= half {
+			entry[16] &^= flagAccessed
+			return true
+		}
+		return false
+	})
+}
+
+// sweep moves the live entries of segment i that keep returns true for to
+// the front of the segment, in order, and evicts the others. keep is given
+// the entry and the offset it would be moved to.
+func (c *Cache) sweep(i int, keep func(entry []byte, w int) bool) {
+	seg := c.segs[i]
+	w := 0
+	for r := 0; r < len(seg); {
+		h := binary.LittleEndian.Uint64(seg[r:])
+		keyLen := int(binary.LittleEndian.Uint32(seg[r+8:]))
+		valueLen := int(binary.LittleEndian.Uint32(seg[r+12:]))
+		size := headerSize + keyLen + valueLen
+
+		if loc, ok := c.index[h]; ok && loc == location(i, r) {
+			if keep(seg[r:r+size], w) {
+				copy(seg[w:], seg[r:r+size])
+				c.index[h] = location(i, w)
+				w += size
+			} else {
+				c.evict(h, loc)
+			}
+		}
+		r += size
+	}
+	c.segs[i] = seg[:w]
+	c.live[i] = w
+}
+
+// kill forgets the entry of h at loc; its bytes become garbage until the
+// segment is recycled.
+func (c *Cache) kill(h, loc uint64) {
+	_, _, keyLen, valueLen := c.entry(loc)
+	delete(c.index, h)
+	c.live[loc>>32] -= headerSize + keyLen + valueLen
+	c.nbytes -= int64(headerSize + keyLen + valueLen)
+}
+
+// evict kills the entry of h at loc and reports it to OnEvicted.
+func (c *Cache) evict(h, loc uint64) {
+	seg, off, keyLen, valueLen := c.entry(loc)
+	c.kill(h, loc)
+	if c.OnEvicted != nil {
+		key := string(seg[off+headerSize : off+headerSize+keyLen])
+		// 段马上会被覆盖，value必须拷贝出来。
+		value := append([]byte(nil), seg[off+headerSize+keyLen:off+headerSize+keyLen+valueLen]...)
+		c.OnEvicted(key, value, expiresAt(seg, off))
+	}
+}
+
+func expiresAt(seg []byte, off int) int64 {
+	return int64(binary.LittleEndian.Uint64(seg[off+17:]))
+}
+
+// Get looks up a key's value and expiry. The value is a copy the caller
+// may keep.
+func (c *Cache) Get(key string) (value []byte, expires int64, ok bool) {
+	return c.get(key, true)
+}
+
+// Peek is like Get without updating the entry's recency.
+func (c *Cache) Peek(key string) (value []byte, expires int64, ok bool) {
+	return c.get(key, false)
+}
+
+func (c *Cache) get(key string, access bool) (value []byte, expires int64, ok bool) {
+	_, loc, ok := c.lookup(key)
+	if !ok {
+		return nil, 0, false
+	}
+	seg, off, keyLen, valueLen := c.entry(loc)
+	if access {
+		seg[off+16] |= flagAccessed
+	}
+	start := off + headerSize + keyLen
+	return append([]byte(nil), seg[start:start+valueLen]...), expiresAt(seg, off), true
+}
+
+// Remove removes the provided key from the cache.
+func (c *Cache) Remove(key string) {
+	if h, loc, ok := c.lookup(key); ok {
+		c.kill(h, loc)
+	}
+}
+
+// RemoveOldest evicts the oldest entry.
+func (c *Cache) RemoveOldest() {
+	c.each(func(h, loc uint64) bool {
+		c.evict(h, loc)
+		return false
+	})
+}
+
+// each calls fn for the live entries from the oldest to the newest until
+// fn returns false.
+func (c *Cache) each(fn func(h, loc uint64) bool) {
+	for n := 1; n <= len(c.segs); n++ {
+		i := (c.cur + n) % len(c.segs)
+		seg := c.segs[i]
+		for off := 0; off < len(seg); {
+			h := binary.LittleEndian.Uint64(seg[off:])
+			keyLen := int(binary.LittleEndian.Uint32(seg[off+8:]))
+			valueLen := int(binary.LittleEndian.Uint32(seg[off+12:]))
+			if loc, ok := c.index[h]; ok && loc == location(i, off) {
+				if !fn(h, loc) {
+					return
+				}
+			}
+			off += headerSize + keyLen + valueLen
+		}
+	}
+}
+
+// Len the number of cache entries
+func (c *Cache) Len() int {
+	return len(c.index)
+}
+
+// Bytes returns the number of bytes taken by live entries, headers
+// included. Overwritten and removed entries keep taking room in their
+// segment until it is recycled.
+func (c *Cache) Bytes() int64 {
+	return c.nbytes
+}
+
+// Keys returns the keys in the cache, roughly from the oldest to the newest.
+func (c *Cache) Keys() []string {
+	keys := make([]string, 0, len(c.index))
+	c.each(func(h, loc uint64) bool {
+		keys = append(keys, string(c.keyAt(loc)))
+		return true
+	})
+	return keys
+}
+
+// Resize changes maxBytes. The entries are copied into new segments, from
+// the oldest to the newest, so the oldest are evicted if they no longer fit.
+func (c *Cache) Resize(maxBytes int64) {
+	if maxBytes == c.maxBytes {
+		return
+	}
+	c.rebuild(New(maxBytes, c.OnEvicted))
+}
+
+// rebuild copies the entries into n, from the oldest to the newest, and
+// makes c n.
+func (c *Cache) rebuild(n *Cache) {
+	c.each(func(h, loc uint64) bool {
+		seg, off, keyLen, valueLen := c.entry(loc)
+		key := string(seg[off+headerSize : off+headerSize+keyLen])
+		value := seg[off+headerSize+keyLen : off+headerSize+keyLen+valueLen]
+		if !n.Add(key, value, expiresAt(seg, off)) && n.OnEvicted != nil {
+			n.OnEvicted(key, value, expiresAt(seg, off)) // 旧的段不会再被复用，不用拷贝
+		}
+		return true
+	})
+	*c = *n
+}
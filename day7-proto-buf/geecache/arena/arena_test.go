@@ -0,0 +1,186 @@
+package arena
+
+import (
+	"fmt"
+	"hash/maphash"
+	"reflect"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	c := New(0, nil)
+	c.Add("key1", []byte("1234"), 0)
+	if v, _, ok := c.Get("key1"); !ok || string(v) != "1234" {
+		t.Fatalf("cache hit key1=1234 failed")
+	}
+	if _, _, ok := c.Get("key2"); ok {
+		t.Fatalf("cache miss key2 failed")
+	}
+
+	c.Add("key1", []byte("5678"), 0)
+	if v, _, ok := c.Get("key1"); !ok || string(v) != "5678" {
+		t.Fatalf("cache hit key1=5678 failed")
+	}
+	if c.Len() != 1 || c.Bytes() != int64(headerSize+len("key1")+len("5678")) {
+		t.Fatalf("Len() = %d, Bytes() = %d", c.Len(), c.Bytes())
+	}
+}
+
+func TestValueIsCopied(t *testing.T) {
+	c := New(0, nil)
+	value := []byte("1234")
+	c.Add("key1", value, 0)
+	value[0] = 'x'
+	v, _, _ := c.Get("key1")
+	v[1] = 'x'
+	if v, _, _ := c.Get("key1"); string(v) != "1234" {
+		t.Fatalf("cached value changed to %q", v)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	c := New(0, nil)
+	c.Add("key1", []byte("1234"), 0)
+	c.Add("key2", []byte("5678"), 0)
+	c.Remove("key1")
+	if _, _, ok := c.Get("key1"); ok {
+		t.Fatalf("Remove key1 failed")
+	}
+	if c.Len() != 1 {
+		t.Fatalf("expect 1 entry, but %d got", c.Len())
+	}
+}
+
+func TestEviction(t *testing.T) {
+	entry := headerSize + len("k0") + 10
+	var evicted []string
+	// 8 segments of 2 entries each.
+	c := New(int64(16*entry), func(key string, value []byte, expires int64) {
+		evicted = append(evicted, key)
+	})
+	for i := 0; i < 16; i++ {
+		c.Add(fmt.Sprintf("k%x", i), make([]byte, 10), 0)
+	}
+	if len(evicted) != 0 || c.Len() != 16 {
+		t.Fatalf("full cache evicted %v and holds %d entries", evicted, c.Len())
+	}
+
+	c.Get("k0")                      // k0 gets a second chance, k1 does not
+	c.Add("new", make([]byte, 9), 0) // as large as the others
+	if !reflect.DeepEqual(evicted, []string{"k1"}) {
+		t.Fatalf("evicted %v, expect [k1]", evicted)
+	}
+	if _, _, ok := c.Get("k0"); !ok {
+		t.Fatalf("recently read k0 was evicted")
+	}
+
+	c.RemoveOldest()
+	if !reflect.DeepEqual(evicted, []string{"k1", "k2"}) {
+		t.Fatalf("RemoveOldest evicted %v, expect k2", evicted)
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	c := New(8*64, nil)
+	c.Add("key", []byte("small"), 0)
+	if c.Add("key", make([]byte, 8*64), 0) {
+		t.Fatalf("value larger than the cache was added")
+	}
+	if _, _, ok := c.Get("key"); ok || c.Len() != 0 {
+		t.Fatalf("old value of key survived a failed Add")
+	}
+}
+
+func TestLargerThanSegment(t *testing.T) {
+	var evicted []string
+	c := New(2<<10, func(key string, value []byte, expires int64) {
+		evicted = append(evicted, key)
+	})
+	c.Add("small", []byte("1234"), 0)
+	// 2KB in 8 segments leaves 256 bytes per segment.
+	if !c.Add("large", make([]byte, 1000), 0) {
+		t.Fatalf("value larger than a segment was rejected")
+	}
+	if v, _, ok := c.Get("large"); !ok || len(v) != 1000 {
+		t.Fatalf("Get(large) = %d bytes, %v", len(v), ok)
+	}
+	if _, _, ok := c.Get("small"); !ok || len(evicted) != 0 {
+		t.Fatalf("growing the segments lost small, evicted %v", evicted)
+	}
+	for i := 0; i < 100; i++ {
+		c.Add(fmt.Sprintf("k%d", i), make([]byte, 100), 0)
+	}
+	if c.Bytes() > 2<<10 {
+		t.Fatalf("cache holds %d bytes", c.Bytes())
+	}
+}
+
+func TestCollision(t *testing.T) {
+	var evicted []string
+	c := New(0, func(key string, value []byte, expires int64) {
+		evicted = append(evicted, key)
+	})
+	c.Add("a", []byte("1"), 0)
+	// Make a look as if its hash were b's.
+	ha, hb := maphash.String(c.seed, "a"), maphash.String(c.seed, "b")
+	c.index[hb] = c.index[ha]
+	delete(c.index, ha)
+
+	c.Add("b", []byte("2"), 0)
+	if !reflect.DeepEqual(evicted, []string{"a"}) {
+		t.Fatalf("evicted %v, expect the colliding key a", evicted)
+	}
+	if v, _, ok := c.Get("b"); !ok || string(v) != "2" || c.Len() != 1 {
+		t.Fatalf("Get(b) = %q, %v", v, ok)
+	}
+}
+
+func TestUnboundedReclaim(t *testing.T) {
+	c := New(0, nil)
+	value := make([]byte, 1000)
+	for i := 0; i < 10000; i++ { // 10MB written, 2KB live
+		c.Add(fmt.Sprintf("k%d", i%2), value, 0)
+	}
+	if len(c.segs) > 2 {
+		t.Fatalf("%d segments for 2 live entries", len(c.segs))
+	}
+	for _, k := range []string{"k0", "k1"} {
+		if _, _, ok := c.Get(k); !ok {
+			t.Fatalf("%s lost", k)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	c := New(0, nil)
+	c.Add("key1", []byte("1"), 0)
+	c.Add("key2", []byte("2"), 0)
+	c.Add("key3", []byte("3"), 0)
+	c.Add("key1", []byte("4"), 0)
+	c.Remove("key2")
+	if keys := c.Keys(); !reflect.DeepEqual(keys, []string{"key3", "key1"}) {
+		t.Fatalf("Keys() = %v", keys)
+	}
+}
+
+func TestResize(t *testing.T) {
+	var evicted []string
+	c := New(0, func(key string, value []byte, expires int64) {
+		evicted = append(evicted, key)
+	})
+	for i := 0; i < 10; i++ {
+		c.Add(fmt.Sprintf("k%d", i), make([]byte, 10), 0)
+	}
+
+	entry := headerSize + len("k0") + 10
+	c.Resize(int64(8 * entry))
+	if c.Len() > 8 || c.Bytes() > int64(8*entry) {
+		t.Fatalf("Resize left %d entries, %d bytes", c.Len(), c.Bytes())
+	}
+	if len(evicted)+c.Len() != 10 || evicted[0] != "k0" {
+		t.Fatalf("evicted %v, %d left", evicted, c.Len())
+	}
+	if _, _, ok := c.Get("k9"); !ok {
+		t.Fatalf("newest entry lost by Resize")
+	}
+}
@@ -4,37 +4,391 @@ package geecache
 
 import (
 	"geecache/lru"
+	"strconv"
 	"sync"
+	"time"
 )
 
-type cache struct {
+// Cache is a concurrency-safe in-process LRU cache of byte values. It
+// needs no Group, Getter or peers, and a Group keeps its own entries in
+// two of them. The zero value is an unbounded cache ready to use.
+type Cache struct {
 	mu         sync.Mutex
-	lru        *lru.Cache // 不可并发的缓存
-	cacheBytes int64      // 最大的缓存容量
+	store      store // 不可并发的缓存，第一次add时才创建
+	cacheBytes int64 // 最大的缓存容量，0表示不限
+	ttl        time.Duration
+	// entryOverhead is counted toward cacheBytes for every entry on top of
+	// its key and value, see WithMemoryLimit.
+	entryOverhead int64
+	// arena keeps the entries in byte arenas instead of an lru.Cache, see
+	// WithArenaStorage.
+	arena bool
+	// onEvicted, if set, is called for every entry that leaves the cache,
+	// after c.mu is released.
+	onEvicted func(key string, value ByteView, reason EvictionReason)
+	// reason is what the store's evictions are reported as; only Resize
+	// and Delete change it while they hold c.mu.
+	reason  EvictionReason
+	pending []eviction // evictions to report once c.mu is released
+
+	nget, nhit, nevict, nexpire int64
+}
+
+// EvictionReason tells why an entry left a cache.
+type EvictionReason int
+
+const (
+	EvictCapacity EvictionReason = iota // evicted to make room for new entries
+	EvictExpired                        // its TTL passed
+	EvictDeleted                        // removed with Delete
+	EvictReplaced                       // overwritten by a new value for its key
+	EvictResized                        // evicted because the cache was made smaller
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictExpired:
+		return "expired"
+	case EvictDeleted:
+		return "deleted"
+	case EvictReplaced:
+		return "replaced"
+	case EvictResized:
+		return "resized"
+	}
+	return "EvictionReason(" + strconv.Itoa(int(r)) + ")"
+}
+
+type eviction struct {
+	key    string
+	value  ByteView
+	reason EvictionReason
+}
+
+// A CacheOption configures a Cache.
+type CacheOption func(*Cache)
+
+// WithTTL makes the entries added with Set expire ttl after they were
+// added. Expired entries are dropped when they are next looked up or
+// reach the end of the LRU list.
+func WithTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.ttl = ttl
+	}
+}
+
+// WithEvictionCallback makes the cache call fn for every entry that
+// leaves it, with the reason why. fn is called after the cache is
+// unlocked, by the goroutine whose call evicted the entry, so it may use
+// the cache.
+func WithEvictionCallback(fn func(key string, value ByteView, reason EvictionReason)) CacheOption {
+	return func(c *Cache) {
+		c.onEvicted = fn
+	}
+}
+
+// WithCacheArena keeps the entries in byte arenas, see WithArenaStorage.
+func WithCacheArena() CacheOption {
+	return func(c *Cache) {
+		c.arena = true
+	}
+}
+
+// NewCache creates a cache holding up to maxBytes bytes of keys and
+// values. A maxBytes of zero means no limit.
+func NewCache(maxBytes int64, opts ...CacheOption) *Cache {
+	c := &Cache{cacheBytes: maxBytes}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// CacheStats are returned by Cache.Stats.
+type CacheStats struct {
+	Bytes       int64
+	Items       int64
+	Gets        int64
+	Hits        int64
+	Evictions   int64 // entries evicted to make room, or by Resize
+	Expirations int64 // entries dropped because their TTL passed
+}
+
+// store is what a Cache keeps its entries in. It is not safe for
+// concurrent use; Cache serializes access to it. expires is in unix
+// nanoseconds, 0 meaning never.
+type store interface {
+	add(key string, value ByteView, expires int64)
+	get(key string) (value ByteView, expires int64, ok bool)
+	peek(key string) (value ByteView, expires int64, ok bool) // without updating recency
+	remove(key string)                                        // reported like any eviction
+	removeOldest()
+	len() int
+	bytes() int64
+	keys() []string // from the oldest to the newest
+	resize(maxBytes int64)
+}
+
+func (c *Cache) newStore() store {
+	if c.arena {
+		return newArenaStore(c.cacheBytes, c.evicted)
+	}
+	l := lru.NewCache(c.cacheBytes, func(key string, e lruEntry) int64 {
+		return int64(len(key)) + int64(e.value.Len())
+	}, func(key string, e lruEntry) {
+		c.evicted(key, e.value, e.expires)
+	})
+	l.SetEntryOverhead(c.entryOverhead)
+	return lruStore{l}
 }
 
-func (c *cache) add(key string, value ByteView) {
+// expiry returns when an entry added now with ttl expires.
+func expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+func expired(expires int64) bool {
+	return expires != 0 && expires <= time.Now().UnixNano()
+}
+
+// Set adds a copy of value to the cache under key.
+func (c *Cache) Set(key string, value []byte) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+// SetWithTTL is like Set with the entry expiring after ttl instead of the
+// cache's TTL. A ttl of zero means never.
+func (c *Cache) SetWithTTL(key string, value []byte, ttl time.Duration) {
+	c.addExpiring(key, ByteView{b: cloneBytes(value)}, expiry(ttl))
+}
+
+// add adds value, which the caller must not modify afterwards, with the
+// cache's TTL.
+func (c *Cache) add(key string, value ByteView) {
+	c.addExpiring(key, value, expiry(c.ttl))
+}
+
+func (c *Cache) addExpiring(key string, value ByteView, expires int64) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
 
-	if c.lru == nil {
-		c.lru = lru.New(c.cacheBytes, nil)
+	if c.store == nil {
+		c.store = c.newStore()
 	}
-	c.lru.Add(key, value)
+	if c.onEvicted != nil {
+		if old, oldExpires, ok := c.store.peek(key); ok {
+			c.report(key, old, oldExpires, EvictReplaced)
+		}
+	}
+	c.store.add(key, value, expires)
+}
+
+// evicted is called by the store, with c.mu held, for every entry it
+// drops.
+func (c *Cache) evicted(key string, value ByteView, expires int64) {
+	c.report(key, value, expires, c.reason)
 }
 
+func (c *Cache) report(key string, value ByteView, expires int64, reason EvictionReason) {
+	if expired(expires) {
+		reason = EvictExpired
+	}
+	switch reason {
+	case EvictExpired:
+		c.nexpire++
+	case EvictCapacity, EvictResized:
+		c.nevict++
+	}
+	if c.onEvicted != nil {
+		c.pending = append(c.pending, eviction{key, value, reason})
+	}
+}
+
+// unlock releases c.mu, then reports the evictions made while it was
+// held. 回调在锁外执行，回调里再用这个cache也不会死锁。
+func (c *Cache) unlock() {
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	for _, e := range pending {
+		c.onEvicted(e.key, e.value, e.reason)
+	}
+}
+
+// Get looks up key's value.
 // 在并发cache里面查询很简单，查字典，有就是有，没有就是没有。
-func (c *cache) get(key string) (value ByteView, ok bool) {
+func (c *Cache) Get(key string) (value ByteView, ok bool) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.nget++
+	if c.store == nil {
+		return
+	}
+	value, expires, ok := c.store.get(key)
+	if !ok {
+		return
+	}
+	if expired(expires) {
+		c.store.remove(key) // reported as expired
+		return ByteView{}, false
+	}
+	c.nhit++
+	return value, true
+}
+
+// peek is like Get without updating the entry's recency or the stats,
+// and also returns when the entry expires.
+func (c *Cache) peek(key string) (value ByteView, expires int64, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.lru == nil {
+	if c.store == nil {
 		return
 	}
+	value, expires, ok = c.store.peek(key)
+	if !ok || expired(expires) {
+		return ByteView{}, 0, false
+	}
+	return value, expires, true
+}
+
+// Delete removes key from the cache.
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.store != nil {
+		c.reason = EvictDeleted
+		c.store.remove(key)
+		c.reason = EvictCapacity
+	}
+}
+
+// Keys returns a snapshot of the cached keys, from the least to the most
+// recently used. It may include expired entries.
+func (c *Cache) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.store == nil {
+		return nil
+	}
+	return c.store.keys()
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.store == nil {
+		return 0
+	}
+	return c.store.len()
+}
+
+// Bytes returns the number of bytes counted toward the cache's maxBytes.
+func (c *Cache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.store == nil {
+		return 0
+	}
+	return c.store.bytes()
+}
+
+// Stats returns the cache's statistics.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := CacheStats{
+		Gets:        c.nget,
+		Hits:        c.nhit,
+		Evictions:   c.nevict,
+		Expirations: c.nexpire,
+	}
+	if c.store != nil {
+		s.Bytes = c.store.bytes()
+		s.Items = int64(c.store.len())
+	}
+	return s
+}
 
-	if v, ok := c.lru.Get(key); ok {
-		return v.(ByteView), ok
+// shrinkBy evicts the oldest entries until n bytes are freed or the cache
+// is empty, and returns how many entries were evicted.
+func (c *Cache) shrinkBy(n int64) int {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.store == nil {
+		return 0
+	}
+	target := c.store.bytes() - n
+	evicted := 0
+	for c.store.len() > 0 && c.store.bytes() > target {
+		c.store.removeOldest()
+		evicted++
 	}
+	return evicted
+}
 
-	return
+// Resize changes the cache's maxBytes, evicting the oldest entries if
+// needed.
+func (c *Cache) Resize(maxBytes int64) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	c.cacheBytes = maxBytes
+	if c.store != nil {
+		c.reason = EvictResized
+		c.store.resize(maxBytes)
+		c.reason = EvictCapacity
+	}
 }
+
+// size returns cacheBytes.
+func (c *Cache) size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cacheBytes
+}
+
+// lruStore is the default store.
+type lruStore struct {
+	*lru.Cache[string, lruEntry]
+}
+
+type lruEntry struct {
+	value   ByteView
+	expires int64
+}
+
+func (s lruStore) add(key string, value ByteView, expires int64) {
+	s.Add(key, lruEntry{value, expires})
+}
+
+func (s lruStore) get(key string) (ByteView, int64, bool) {
+	e, ok := s.Get(key)
+	return e.value, e.expires, ok
+}
+
+func (s lruStore) peek(key string) (ByteView, int64, bool) {
+	e, ok := s.Peek(key)
+	return e.value, e.expires, ok
+}
+
+func (s lruStore) remove(key string)     { s.Remove(key) }
+func (s lruStore) removeOldest()         { s.RemoveOldest() }
+func (s lruStore) len() int              { return s.Len() }
+func (s lruStore) bytes() int64          { return s.Bytes() }
+func (s lruStore) keys() []string        { return s.Keys() }
+func (s lruStore) resize(maxBytes int64) { s.Resize(maxBytes) }
@@ -0,0 +1,159 @@
+package geecache
+
+import (
+	"reflect"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	for _, arena := range []bool{false, true} {
+		var evicted []string
+		opts := []CacheOption{WithEvictionCallback(func(key string, value ByteView, reason EvictionReason) {
+			if reason == EvictCapacity {
+				evicted = append(evicted, key+"="+value.String())
+			}
+		})}
+		if arena {
+			opts = append(opts, WithCacheArena())
+		}
+		c := NewCache(1<<10, opts...)
+
+		value := []byte("630")
+		c.Set("Tom", value)
+		value[0] = 'x'
+		if v, ok := c.Get("Tom"); !ok || v.String() != "630" {
+			t.Fatalf("arena=%v: Get(Tom) = %q, %v", arena, v.String(), ok)
+		}
+		c.Delete("Tom")
+		if _, ok := c.Get("Tom"); ok {
+			t.Fatalf("arena=%v: Tom survived Delete", arena)
+		}
+
+		for i := 0; i < 100; i++ {
+			c.Set(strconv.Itoa(i), make([]byte, 50))
+		}
+		s := c.Stats()
+		if s.Gets != 2 || s.Hits != 1 || s.Evictions == 0 || int(s.Evictions) != len(evicted) ||
+			s.Items != int64(c.Len()) || s.Bytes > 1<<10 {
+			t.Fatalf("arena=%v: unexpected stats %+v after %d evictions", arena, s, len(evicted))
+		}
+		if evicted[0] != "0="+string(make([]byte, 50)) {
+			t.Fatalf("arena=%v: expect 0 to be evicted first, got %q", arena, evicted[0])
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	var evicted []string
+	c := NewCache(0, WithTTL(20*time.Millisecond), WithEvictionCallback(func(key string, value ByteView, reason EvictionReason) {
+		evicted = append(evicted, key+" "+reason.String())
+	}))
+	c.Set("short", []byte("1"))
+	c.SetWithTTL("long", []byte("2"), time.Hour)
+	if _, ok := c.Get("short"); !ok {
+		t.Fatalf("short expired too early")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("short"); ok {
+		t.Fatalf("short did not expire")
+	}
+	if _, ok := c.Get("long"); !ok {
+		t.Fatalf("long expired with the cache TTL instead of its own")
+	}
+	if s := c.Stats(); s.Expirations != 1 || s.Items != 1 || !reflect.DeepEqual(evicted, []string{"short expired"}) {
+		t.Fatalf("unexpected stats %+v, evicted %v", s, evicted)
+	}
+	if keys := c.Keys(); !reflect.DeepEqual(keys, []string{"long"}) {
+		t.Fatalf("Keys() = %v", keys)
+	}
+}
+
+const benchEntries = 500000
+
+func newBenchCache(arena bool) *Cache {
+	c := &Cache{cacheBytes: 1 << 30, arena: arena}
+	value := make([]byte, 64)
+	for i := 0; i < benchEntries; i++ {
+		c.add(strconv.Itoa(i), ByteView{b: append([]byte(nil), value...)})
+	}
+	return c
+}
+
+func gcCPUSeconds() float64 {
+	s := []metrics.Sample{{Name: "/cpu/classes/gc/total:cpu-seconds"}}
+	metrics.Read(s)
+	return s[0].Value.Float64()
+}
+
+func TestEvictionReasons(t *testing.T) {
+	for _, arena := range []bool{false, true} {
+		var c *Cache
+		var reasons []string
+		opts := []CacheOption{WithEvictionCallback(func(key string, value ByteView, reason EvictionReason) {
+			reasons = append(reasons, key+"="+value.String()+" "+reason.String())
+			c.Len() // the cache is not locked any more
+		})}
+		if arena {
+			opts = append(opts, WithCacheArena())
+		}
+		c = NewCache(0, opts...)
+
+		c.Set("a", []byte("1"))
+		c.Set("a", []byte("2"))
+		c.Delete("a")
+		c.SetWithTTL("b", []byte("3"), time.Nanosecond)
+		time.Sleep(time.Millisecond)
+		c.Get("b")
+		for i := 0; i < 100; i++ {
+			c.Set(strconv.Itoa(i), make([]byte, 100))
+		}
+		c.Resize(1 << 10)
+
+		expect := []string{"a=1 replaced", "a=2 deleted", "b=3 expired"}
+		if len(reasons) < 4 || !reflect.DeepEqual(reasons[:3], expect) || !strings.HasSuffix(reasons[3], " resized") {
+			t.Fatalf("arena=%v: got evictions %q", arena, reasons)
+		}
+	}
+}
+
+// BenchmarkGC measures a full garbage collection with a cache of
+// benchEntries small entries alive, reporting the GC CPU time it took.
+func BenchmarkGC(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		arena bool
+	}{{"lru", false}, {"arena", true}} {
+		b.Run(bc.name, func(b *testing.B) {
+			c := newBenchCache(bc.arena)
+			runtime.GC()
+			b.ResetTimer()
+			start := gcCPUSeconds()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+			}
+			b.ReportMetric((gcCPUSeconds()-start)*1e3/float64(b.N), "gc-cpu-ms/op")
+			runtime.KeepAlive(c)
+		})
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		arena bool
+	}{{"lru", false}, {"arena", true}} {
+		b.Run(bc.name, func(b *testing.B) {
+			c := newBenchCache(bc.arena)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Get(strconv.Itoa(i % benchEntries))
+			}
+		})
+	}
+}
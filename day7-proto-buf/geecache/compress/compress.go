@@ -0,0 +1,166 @@
+// Package compress provides the codecs a geecache Group can use to
+// compress the values it stores and sends to peers.
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sort"
+)
+
+// Codec compresses and decompresses values. Codecs are identified on the
+// wire by their Name, so the name of a codec must never change.
+type Codec interface {
+	Name() string
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+var (
+	// None stores values as they are.
+	None Codec = none{}
+	// Gzip uses compress/gzip.
+	Gzip Codec = gzipCodec{}
+	// Flate uses compress/flate, which is gzip without the header.
+	Flate Codec = flateCodec{}
+	// LZ4 is a fast LZ4 block format codec. It compresses less than
+	// gzip but costs far less CPU.
+	LZ4 Codec = lz4Codec{}
+)
+
+// ErrTooLarge is returned by DecodeLimit for values that decode to more
+// than the limit.
+var ErrTooLarge = errors.New("compress: decoded value too large")
+
+// limitDecoder is implemented by the codecs that can stop decoding as
+// soon as the output exceeds a limit.
+type limitDecoder interface {
+	decodeLimit(src []byte, limit int64) ([]byte, error)
+}
+
+// DecodeLimit decodes src with c, failing with ErrTooLarge once the output
+// exceeds limit bytes, so that a small compressed value can't make the
+// caller allocate without bound. A limit <= 0 means no limit.
+func DecodeLimit(c Codec, src []byte, limit int64) ([]byte, error) {
+	if ld, ok := c.(limitDecoder); ok {
+		return ld.decodeLimit(src, limit)
+	}
+	b, err := c.Decode(src)
+	if err == nil && limit > 0 && int64(len(b)) > limit {
+		return nil, ErrTooLarge
+	}
+	return b, err
+}
+
+// readLimit reads r to the end, or fails with ErrTooLarge once more than
+// limit bytes were read.
+func readLimit(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err == nil && int64(len(b)) > limit {
+		return nil, ErrTooLarge
+	}
+	return b, err
+}
+
+var codecs = map[string]Codec{
+	None.Name():  None,
+	Gzip.Name():  Gzip,
+	Flate.Name(): Flate,
+	LZ4.Name():   LZ4,
+}
+
+// Lookup returns the codec called name. The empty name means None.
+func Lookup(name string) (Codec, bool) {
+	if name == "" {
+		return None, true
+	}
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Names returns the names of every codec, sorted.
+func Names() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type none struct{}
+
+func (none) Name() string                      { return "none" }
+func (none) Encode(src []byte) ([]byte, error) { return src, nil }
+func (none) Decode(src []byte) ([]byte, error) { return src, nil }
+
+func (none) decodeLimit(src []byte, limit int64) ([]byte, error) {
+	if limit > 0 && int64(len(src)) > limit {
+		return nil, ErrTooLarge
+	}
+	return src, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Decode(src []byte) ([]byte, error) {
+	return c.decodeLimit(src, 0)
+}
+
+func (gzipCodec) decodeLimit(src []byte, limit int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimit(r, limit)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Name() string { return "flate" }
+
+func (flateCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c flateCodec) Decode(src []byte) ([]byte, error) {
+	return c.decodeLimit(src, 0)
+}
+
+func (flateCodec) decodeLimit(src []byte, limit int64) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readLimit(r, limit)
+}
@@ -0,0 +1,92 @@
+package compress
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func testInputs() map[string][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 4096)
+	rnd.Read(random)
+
+	return map[string][]byte{
+		"empty":  {},
+		"short":  []byte("630"),
+		"json":   []byte(strings.Repeat(`{"name":"Tom","score":630,"tags":["a","b"]},`, 200)),
+		"run":    bytes.Repeat([]byte{'x'}, 70000),
+		"random": random,
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, name := range Names() {
+		c, _ := Lookup(name)
+		for input, src := range testInputs() {
+			enc, err := c.Encode(src)
+			if err != nil {
+				t.Fatalf("%s: encode %s: %v", name, input, err)
+			}
+			dec, err := c.Decode(enc)
+			if err != nil {
+				t.Fatalf("%s: decode %s: %v", name, input, err)
+			}
+			if !bytes.Equal(dec, src) {
+				t.Fatalf("%s: %s did not survive the round trip", name, input)
+			}
+		}
+	}
+}
+
+func TestLZ4Compresses(t *testing.T) {
+	src := testInputs()["json"]
+	enc, _ := LZ4.Encode(src)
+	if len(enc) > len(src)/5 {
+		t.Fatalf("expect repetitive JSON to shrink at least 5x, %d -> %d", len(src), len(enc))
+	}
+}
+
+func TestLZ4Corrupt(t *testing.T) {
+	enc, _ := LZ4.Encode(testInputs()["json"])
+	for i := 0; i < len(enc); i += 7 {
+		bad := bytes.Clone(enc)
+		bad[i] ^= 0x5a
+		LZ4.Decode(bad) // must not panic
+	}
+	if _, err := LZ4.Decode(enc[:len(enc)/2]); err == nil {
+		t.Fatal("truncated block should be rejected")
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	src := testInputs()["json"]
+	for _, name := range Names() {
+		c, _ := Lookup(name)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for i := 0; i < b.N; i++ {
+				c.Encode(src)
+			}
+		})
+	}
+}
+
+func TestDecodeLimit(t *testing.T) {
+	// 1MB of zeros compresses to about 1KB with every codec but None.
+	bomb := make([]byte, 1<<20)
+	for _, name := range Names() {
+		c, _ := Lookup(name)
+		enc, _ := c.Encode(bomb)
+		if _, err := DecodeLimit(c, enc, 1<<10); err != ErrTooLarge {
+			t.Errorf("%s: DecodeLimit of %d bytes to 1KB = %v", name, len(enc), err)
+		}
+		if dec, err := DecodeLimit(c, enc, 1<<20); err != nil || len(dec) != 1<<20 {
+			t.Errorf("%s: DecodeLimit at the exact size = %d bytes, %v", name, len(dec), err)
+		}
+		if dec, err := DecodeLimit(c, enc, 0); err != nil || len(dec) != 1<<20 {
+			t.Errorf("%s: DecodeLimit without a limit = %d bytes, %v", name, len(dec), err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package compress
+
+// LZ4 block format, see https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md.
+// The block is prefixed with the uncompressed length as a uvarint so
+// Decode can allocate the output once.
+//
+// A block is a list of sequences. Each sequence is a token byte whose
+// high nibble is the literal length and low nibble the match length minus
+// 4 (15 means more length bytes follow), the literals, and a 2-byte
+// little endian offset back into the output where the match is copied
+// from. The last sequence has only literals.
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // the last 5 bytes are always literals
+	lz4MFLimit      = 12 // a match can't start in the last 12 bytes
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 16
+)
+
+var errCorrupt = errors.New("compress: corrupt lz4 block")
+
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string { return "lz4" }
+
+func (lz4Codec) Encode(src []byte) ([]byte, error) {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/255+16)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+	return lz4Compress(dst, src), nil
+}
+
+func (c lz4Codec) Decode(src []byte) ([]byte, error) {
+	return c.decodeLimit(src, 0)
+}
+
+func (lz4Codec) decodeLimit(src []byte, limit int64) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, errCorrupt
+	}
+	if limit > 0 && n > uint64(limit) {
+		return nil, ErrTooLarge // 长度写在最前面，不用解压就知道
+	}
+	src = src[k:]
+	// 每个输入字节最多展开成255个输出字节，据此拒绝伪造的长度，避免一次分配过大的内存。
+	if n > uint64(len(src))*255+16 {
+		return nil, errCorrupt
+	}
+	return lz4Decompress(make([]byte, 0, n), src, int(n))
+}
+
+func lz4Hash(u uint32) uint32 {
+	return (u * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4Compress appends the compressed block of src to dst.
+func lz4Compress(dst, src []byte) []byte {
+	var table [1 << lz4HashLog]int32 // position+1 of the last occurrence of a hash, 0 = none
+
+	anchor := 0 // start of the pending literals
+	for i := 0; i+lz4MFLimit <= len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(seq)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+
+		n := lz4MinMatch
+		for i+n < len(src)-lz4LastLiterals && src[ref+n] == src[i+n] {
+			n++
+		}
+		dst = lz4Sequence(dst, src[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	return lz4Sequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4Sequence appends one sequence. A zero matchLen ends the block.
+func lz4Sequence(dst, literals []byte, offset, matchLen int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if matchLen > 0 {
+		token |= byte(min(matchLen-lz4MinMatch, 15))
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4Length(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLen-lz4MinMatch >= 15 {
+		dst = lz4Length(dst, matchLen-lz4MinMatch-15)
+	}
+	return dst
+}
+
+func lz4Length(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4Decompress appends the decompressed block src to dst, which must
+// end up n bytes long.
+func lz4Decompress(dst, src []byte, n int) ([]byte, error) {
+	readLength := func(i *int, l int) (int, error) {
+		for {
+			if *i >= len(src) {
+				return 0, errCorrupt
+			}
+			b := src[*i]
+			*i++
+			l += int(b)
+			if l > n {
+				return 0, errCorrupt
+			}
+			if b != 255 {
+				return l, nil
+			}
+		}
+	}
+
+	var err error
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		lit := int(token >> 4)
+		if lit == 15 {
+			if lit, err = readLength(&i, lit); err != nil {
+				return nil, err
+			}
+		}
+		if i+lit > len(src) || len(dst)+lit > n {
+			return nil, errCorrupt
+		}
+		dst = append(dst, src[i:i+lit]...)
+		i += lit
+		if i == len(src) {
+			break // the last sequence has no match
+		}
+
+		if i+2 > len(src) {
+			return nil, errCorrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errCorrupt
+		}
+
+		matchLen := int(token & 15)
+		if matchLen == 15 {
+			if matchLen, err = readLength(&i, matchLen); err != nil {
+				return nil, err
+			}
+		}
+		matchLen += lz4MinMatch
+		if len(dst)+matchLen > n {
+			return nil, errCorrupt
+		}
+		// 匹配区间可能和正在写的区间重叠（例如offset=1表示重复上一个字节），只能逐字节拷贝。
+		start := len(dst) - offset
+		for k := 0; k < matchLen; k++ {
+			dst = append(dst, dst[start+k])
+		}
+	}
+
+	if len(dst) != n {
+		return nil, errCorrupt
+	}
+	return dst, nil
+}
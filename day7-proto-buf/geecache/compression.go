@@ -0,0 +1,126 @@
+package geecache
+
+// 值很大（比如JSON）的时候，mainCache和peer之间的带宽都很快被占满。
+// group可以配置一个compress.Codec：值在放进缓存之前先编码，缓存、磁盘、snapshot
+// 和handoff里存的都是编码后的形式，只有Get返回给调用方之前才解码。
+// peer之间用X-Geecache-Accept-Codec头协商：对方认识我们的codec就直接发编码后的字节。
+
+import (
+	"fmt"
+	"geecache/compress"
+	"strings"
+)
+
+// WithCompression makes the group store its values encoded with c. Values
+// are decoded again by Get, and sent encoded to peers that know c.
+func WithCompression(c compress.Codec) GroupOption {
+	return func(g *Group) {
+		if c != nil {
+			g.codec = c
+		}
+	}
+}
+
+// encode turns a value loaded by the getter into its stored form.
+func (g *Group) encode(v ByteView) (ByteView, error) {
+	if g.codec == compress.None {
+		g.Stats.RawBytes.Add(int64(v.Len()))
+		g.Stats.StoredBytes.Add(int64(v.Len()))
+		return v, nil
+	}
+	enc, err := g.codec.Encode(v.bytes())
+	if err != nil {
+		return ByteView{}, fmt.Errorf("geecache: %s encode: %v", g.codec.Name(), err)
+	}
+	g.Stats.RawBytes.Add(int64(v.Len()))
+	g.Stats.StoredBytes.Add(int64(len(enc)))
+	return ByteView{b: enc}, nil
+}
+
+// decode turns a stored value back into what the getter returned.
+func (g *Group) decode(v ByteView) (ByteView, error) {
+	if g.codec == compress.None {
+		return v, nil
+	}
+	b, err := g.codec.Decode(v.bytes())
+	if err != nil {
+		return ByteView{}, fmt.Errorf("geecache: %s decode: %v", g.codec.Name(), err)
+	}
+	return ByteView{b: b}, nil
+}
+
+// maxDecodedSize caps the values transcode decodes for groups without a
+// max value size.
+const maxDecodedSize = 1 << 30
+
+// transcode turns b, the value of key encoded with the codec called name
+// by a peer or a snapshot, into the stored form of this group. Decoding
+// stops with a *ValueTooLargeError once the value exceeds the group's max
+// value size.
+func (g *Group) transcode(key string, b []byte, name string) (ByteView, error) {
+	c, ok := compress.Lookup(name)
+	if !ok {
+		return ByteView{}, fmt.Errorf("geecache: unknown codec %q", name)
+	}
+	if c.Name() == g.codec.Name() {
+		return ByteView{b: b}, nil
+	}
+	limit := g.maxValueSize
+	if limit <= 0 {
+		limit = maxDecodedSize
+	}
+	raw, err := compress.DecodeLimit(c, b, limit)
+	if err == compress.ErrTooLarge {
+		return ByteView{}, &ValueTooLargeError{Group: g.name, Key: key, Limit: limit}
+	}
+	if err != nil {
+		return ByteView{}, fmt.Errorf("geecache: %s decode: %v", name, err)
+	}
+	enc, err := g.codec.Encode(raw)
+	if err != nil {
+		return ByteView{}, fmt.Errorf("geecache: %s encode: %v", g.codec.Name(), err)
+	}
+	return ByteView{b: enc}, nil
+}
+
+// wireValue returns the bytes to send for the stored value v to a client
+// accepting the codecs listed in accept, and the name of their codec.
+func (g *Group) wireValue(v ByteView, accept string) ([]byte, string, error) {
+	if g.codec == compress.None {
+		return v.bytes(), "", nil
+	}
+	for _, name := range strings.Split(accept, ",") {
+		if strings.TrimSpace(name) == g.codec.Name() {
+			return v.bytes(), g.codec.Name(), nil
+		}
+	}
+	raw, err := g.decode(v)
+	if err != nil {
+		return nil, "", err
+	}
+	return raw.bytes(), "", nil
+}
+
+// checkSize returns a *ValueTooLargeError if value, as returned by
+// wireValue with codec, is larger than limit once decoded: the max value
+// size always applies to values as the getter returned them.
+func (g *Group) checkSize(key string, value []byte, codec string, limit int64) error {
+	limit = g.valueLimit(limit)
+	if limit <= 0 || (codec != "" && limit == g.maxValueSize) {
+		return nil // 进缓存之前已经按这个limit检查过了，不用再解码一遍
+	}
+	if codec == "" {
+		if int64(len(value)) <= limit {
+			return nil
+		}
+	} else if _, err := compress.DecodeLimit(g.codec, value, limit); err != compress.ErrTooLarge {
+		if err != nil {
+			return fmt.Errorf("geecache: %s decode: %v", codec, err)
+		}
+		return nil
+	}
+	return &ValueTooLargeError{Group: g.name, Key: key, Limit: limit}
+}
+
+// acceptCodecs is the value of acceptCodecHeader sent by httpGetter.
+var acceptCodecs = strings.Join(compress.Names(), ",")
@@ -1,9 +1,11 @@
 package consistenthash
 
 import (
+	"fmt"
 	"hash/crc32"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 // Hash maps bytes to uint32
@@ -57,3 +59,50 @@ func (m *Map) Get(key string) string {
 
 	return m.hashMap[m.keys[idx%len(m.keys)]]
 }
+
+// GetN returns up to n distinct nodes for key, walking clockwise from the
+// key's position on the ring. The first node is the one Get returns.
+func (m *Map) GetN(key string, n int) []string {
+	if len(m.keys) == 0 || n <= 0 {
+		return nil
+	}
+
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+
+	var nodes []string
+	seen := make(map[string]bool, n)
+	for i := 0; i < len(m.keys) && len(nodes) < n; i++ {
+		node := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Members returns the sorted list of distinct nodes on the ring.
+func (m *Map) Members() []string {
+	seen := make(map[string]bool, len(m.hashMap))
+	var members []string
+	for _, node := range m.hashMap {
+		if !seen[node] {
+			seen[node] = true
+			members = append(members, node)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Digest summarizes the ring's membership and replica count. Two maps
+// built from the same nodes always produce the same digest, so peers can
+// compare digests to find out whether they agree on key ownership.
+func (m *Map) Digest() string {
+	h := crc32.NewIEEE()
+	fmt.Fprintf(h, "%d\n%s", m.replicas, strings.Join(m.Members(), "\n"))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
@@ -1,6 +1,7 @@
 package consistenthash
 
 import (
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -41,3 +42,45 @@ func TestHashing(t *testing.T) {
 	}
 
 }
+
+func TestDigest(t *testing.T) {
+	a := New(3, nil)
+	a.Add("http://localhost:8001", "http://localhost:8002")
+	b := New(3, nil)
+	b.Add("http://localhost:8002", "http://localhost:8001")
+
+	if a.Digest() != b.Digest() {
+		t.Errorf("same members in different order should have the same digest")
+	}
+
+	b.Add("http://localhost:8003")
+	if a.Digest() == b.Digest() {
+		t.Errorf("different members should have different digests")
+	}
+}
+
+func TestGetN(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+
+	// 2, 4, 6, 12, 14, 16, 22, 24, 26
+	hash.Add("6", "4", "2")
+
+	testCases := map[string][]string{
+		"2":  {"2", "4"},
+		"11": {"2", "4"},
+		"23": {"4", "6"},
+		"27": {"2", "4"},
+	}
+	for k, v := range testCases {
+		if nodes := hash.GetN(k, 2); !reflect.DeepEqual(nodes, v) {
+			t.Errorf("Asking for %s, should have yielded %v, got %v", k, v, nodes)
+		}
+	}
+
+	if nodes := hash.GetN("2", 5); len(nodes) != 3 {
+		t.Errorf("GetN should return at most every node, got %v", nodes)
+	}
+}
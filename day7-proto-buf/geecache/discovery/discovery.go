@@ -0,0 +1,93 @@
+// Package discovery provides sources of peer sets for an HTTPPool.
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// defaultInterval is how often polling sources look for changes.
+const defaultInterval = 5 * time.Second
+
+// Discovery is the interface that must be implemented by a source of peers.
+type Discovery interface {
+	// Watch sends the current peer set and then every change to it.
+	// The channel is closed once ctx is done.
+	Watch(ctx context.Context) (<-chan []string, error)
+}
+
+// A Static is a fixed peer set.
+type Static []string
+
+// NewStatic returns a Discovery that always reports peers.
+func NewStatic(peers ...string) Static {
+	return Static(peers)
+}
+
+// Watch sends the peer set once and closes the channel when ctx is done.
+func (s Static) Watch(ctx context.Context) (<-chan []string, error) {
+	ch := make(chan []string, 1)
+	ch <- slices.Clone(s)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// poll calls fetch every interval and sends its result whenever the peer set
+// changes. A failed fetch is logged to logger, if not nil, and the last
+// known peer set is kept.
+func poll(ctx context.Context, interval time.Duration, logger *slog.Logger, fetch func(context.Context) ([]string, error)) <-chan []string {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	ch := make(chan []string)
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last []string
+		for {
+			peers, err := fetch(ctx)
+			if err != nil {
+				logger.Warn("fetching peers failed", "error", err)
+			} else if peers = normalize(peers); last == nil || !slices.Equal(last, peers) {
+				// 只在peer集合变化时通知，避免HTTPPool反复重建hash环。
+				select {
+				case ch <- peers:
+					last = peers
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// normalize sorts peers and drops duplicates and empty entries so two
+// peer sets can be compared with slices.Equal.
+func normalize(peers []string) []string {
+	out := make([]string, 0, len(peers))
+	for _, p := range peers {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func next(t *testing.T, ch <-chan []string) []string {
+	t.Helper()
+	select {
+	case peers := <-ch:
+		return peers
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a peer update")
+		return nil
+	}
+}
+
+func TestStatic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, _ := NewStatic("http://localhost:8001", "http://localhost:8002").Watch(ctx)
+
+	expect := []string{"http://localhost:8001", "http://localhost:8002"}
+	if peers := next(t, ch); !reflect.DeepEqual(peers, expect) {
+		t.Fatalf("expect %v, but %v got", expect, peers)
+	}
+
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatal("channel should be closed once ctx is done")
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	os.WriteFile(path, []byte(`["http://localhost:8002", "http://localhost:8001"]`), 0644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := NewFile(path, 10*time.Millisecond).Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"http://localhost:8001", "http://localhost:8002"}
+	if peers := next(t, ch); !reflect.DeepEqual(peers, expect) {
+		t.Fatalf("expect %v, but %v got", expect, peers)
+	}
+
+	os.WriteFile(path, []byte(`{"peers": ["http://localhost:8003"]}`), 0644)
+	expect = []string{"http://localhost:8003"}
+	if peers := next(t, ch); !reflect.DeepEqual(peers, expect) {
+		t.Fatalf("expect %v, but %v got", expect, peers)
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	data := []byte(`# geecache peers
+peers:
+  - http://localhost:8001   # first
+  - "http://localhost:8002"
+`)
+	peers, err := parseYAML(data)
+	expect := []string{"http://localhost:8001", "http://localhost:8002"}
+	if err != nil || !reflect.DeepEqual(peers, expect) {
+		t.Fatalf("expect %v, but %v, %v got", expect, peers, err)
+	}
+
+	if _, err := parseYAML([]byte("peers: [a, b]")); err == nil {
+		t.Fatal("flow sequences should be rejected")
+	}
+}
+
+// fakeResolver answers DNS lookups from memory.
+type fakeResolver struct {
+	mu    sync.Mutex
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cname := "_" + service + "._" + proto + "." + name
+	if srvs, ok := r.srv[cname]; ok {
+		return cname, srvs, nil
+	}
+	return "", nil, errors.New("no such host")
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestDNS(t *testing.T) {
+	r := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_geecache._tcp.cache.local": {
+				{Target: "node1.cache.local.", Port: 8001},
+				{Target: "node2.cache.local.", Port: 8002},
+			},
+		},
+		hosts: map[string][]string{
+			"cache.local": {"10.0.0.2", "10.0.0.1"},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := NewDNSSRV("geecache", "cache.local", time.Hour)
+	srv.Resolver = r
+	ch, _ := srv.Watch(ctx)
+	expect := []string{"http://node1.cache.local:8001", "http://node2.cache.local:8002"}
+	if peers := next(t, ch); !reflect.DeepEqual(peers, expect) {
+		t.Fatalf("expect %v, but %v got", expect, peers)
+	}
+
+	a := NewDNS("cache.local", 8001, 10*time.Millisecond)
+	a.Resolver = r
+	ch, _ = a.Watch(ctx)
+	expect = []string{"http://10.0.0.1:8001", "http://10.0.0.2:8001"}
+	if peers := next(t, ch); !reflect.DeepEqual(peers, expect) {
+		t.Fatalf("expect %v, but %v got", expect, peers)
+	}
+
+	// A node joins; the change is reported on the next poll.
+	r.mu.Lock()
+	r.hosts["cache.local"] = []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	r.mu.Unlock()
+	expect = append(expect, "http://10.0.0.3:8001")
+	if peers := next(t, ch); !reflect.DeepEqual(peers, expect) {
+		t.Fatalf("expect %v, but %v got", expect, peers)
+	}
+}
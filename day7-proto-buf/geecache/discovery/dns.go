@@ -0,0 +1,90 @@
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver is the part of *net.Resolver used by DNS. Tests can swap in a
+// stand-in that answers from memory.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// A DNS finds peers through DNS records. If Service is set it looks up
+// the SRV records _Service._Proto.Name and uses their targets and ports;
+// otherwise it looks up the A/AAAA records of Name and pairs every address
+// with Port.
+type DNS struct {
+	Name     string
+	Service  string // SRV service, e.g. "geecache"
+	Proto    string // SRV protocol, defaults to "tcp"
+	Port     int    // port used with A/AAAA records
+	Scheme   string // scheme of the peer URLs, defaults to "http"
+	Interval time.Duration
+	Resolver Resolver     // defaults to net.DefaultResolver
+	Logger   *slog.Logger // failed lookups are logged here, nothing is logged by default
+}
+
+// NewDNS returns a Discovery that resolves the A/AAAA records of name.
+func NewDNS(name string, port int, interval time.Duration) *DNS {
+	return &DNS{Name: name, Port: port, Interval: interval}
+}
+
+// NewDNSSRV returns a Discovery that resolves the SRV records of
+// _service._tcp.name.
+func NewDNSSRV(service, name string, interval time.Duration) *DNS {
+	return &DNS{Name: name, Service: service, Interval: interval}
+}
+
+// Watch resolves the records every Interval and sends the peer set
+// whenever it changes.
+func (d *DNS) Watch(ctx context.Context) (<-chan []string, error) {
+	return poll(ctx, d.Interval, d.Logger, d.lookup), nil
+}
+
+func (d *DNS) lookup(ctx context.Context) ([]string, error) {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	var peers []string
+	if d.Service != "" {
+		proto := d.Proto
+		if proto == "" {
+			proto = "tcp"
+		}
+		_, srvs, err := r.LookupSRV(ctx, d.Service, proto, d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			peers = append(peers, peerURL(scheme, host, int(srv.Port)))
+		}
+		return peers, nil
+	}
+
+	addrs, err := r.LookupHost(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		peers = append(peers, peerURL(scheme, addr, d.Port))
+	}
+	return peers, nil
+}
+
+func peerURL(scheme, host string, port int) string {
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
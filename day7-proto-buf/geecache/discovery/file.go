@@ -0,0 +1,122 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A File reads the peer set from a JSON or YAML file and watches it for
+// changes. The file holds either a bare list of peers or an object with a
+// "peers" list, e.g.
+//
+//	{"peers": ["http://localhost:8001", "http://localhost:8002"]}
+//
+//	peers:
+//	  - http://localhost:8001
+//	  - http://localhost:8002
+type File struct {
+	Path     string
+	Interval time.Duration // how often the file is checked, defaults to 5s
+	Logger   *slog.Logger  // failed reads are logged here, nothing is logged by default
+}
+
+// NewFile returns a Discovery that watches the peer file at path.
+func NewFile(path string, interval time.Duration) *File {
+	return &File{Path: path, Interval: interval}
+}
+
+// Watch sends the peers listed in the file and then the new list every
+// time the file changes.
+func (f *File) Watch(ctx context.Context) (<-chan []string, error) {
+	// 先读一次，文件不存在或格式错误时直接报错，而不是默默等待。
+	if _, err := f.read(); err != nil {
+		return nil, err
+	}
+
+	var modTime time.Time
+	var size int64
+	var peers []string
+	return poll(ctx, f.Interval, f.Logger, func(context.Context) ([]string, error) {
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if peers != nil && info.ModTime().Equal(modTime) && info.Size() == size {
+			return peers, nil
+		}
+		p, err := f.read()
+		if err != nil {
+			return nil, err
+		}
+		modTime, size, peers = info.ModTime(), info.Size(), p
+		return peers, nil
+	}), nil
+}
+
+func (f *File) read() ([]string, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []string
+	switch ext := strings.ToLower(filepath.Ext(f.Path)); ext {
+	case ".json":
+		peers, err = parseJSON(data)
+	case ".yaml", ".yml":
+		peers, err = parseYAML(data)
+	default:
+		return nil, fmt.Errorf("discovery: unsupported peer file type %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("discovery: parsing %s: %v", f.Path, err)
+	}
+	return peers, nil
+}
+
+func parseJSON(data []byte) ([]string, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var peers []string
+		err := json.Unmarshal(data, &peers)
+		return peers, err
+	}
+
+	var doc struct {
+		Peers []string `json:"peers"`
+	}
+	err := json.Unmarshal(data, &doc)
+	return doc.Peers, err
+}
+
+// parseYAML understands the small subset of YAML used by peer files: a
+// list of scalars, optionally under a top-level "peers:" key.
+func parseYAML(data []byte) ([]string, error) {
+	var peers []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line[0] == '#' || line == "---":
+		case line == "peers:":
+		case strings.HasPrefix(line, "- ") || line == "-":
+			peer := strings.TrimSpace(strings.TrimPrefix(line, "-"))
+			peers = append(peers, strings.Trim(peer, `"'`))
+		default:
+			return nil, fmt.Errorf("line %d: unexpected %q", n, line)
+		}
+	}
+	return peers, sc.Err()
+}
@@ -0,0 +1,437 @@
+// Package disk implements an append-only, log-structured key/value store
+// on local disk, used as a second cache tier under geecache's mainCache.
+//
+// Every Put or Delete appends a record to the log; an in-memory index maps
+// each live key to the position of its latest value. Records that were
+// overwritten or deleted become garbage, which Compact reclaims by copying
+// the live records into a fresh log. A store given MaxBytes evicts the
+// oldest keys once its live records take more room than that.
+package disk
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// record layout: crc32 | flags | len(key) | len(value) | key | value.
+// The checksum covers everything after itself.
+const (
+	headerSize = 4 + 1 + 4 + 4
+
+	flagTombstone = 1 << 0
+
+	logName     = "data.log"
+	compactName = "data.log.compact"
+)
+
+// ErrNotFound is returned by Get for keys that are not in the store.
+var ErrNotFound = errors.New("disk: key not found")
+
+// ErrTooLarge is returned by Put for values that would not fit in MaxBytes
+// on their own.
+var ErrTooLarge = errors.New("disk: value larger than the store")
+
+// Options configure a Store.
+type Options struct {
+	// CompactRatio triggers compaction once that fraction of the log is
+	// garbage. Defaults to 0.5; negative disables automatic compaction.
+	CompactRatio float64
+	// CompactMinSize is the log size under which compaction never runs
+	// automatically. Defaults to 1MB.
+	CompactMinSize int64
+	// MaxBytes, if positive, limits the size of the live records. When a
+	// Put goes over it, the oldest keys are evicted until the live records
+	// take at most 90% of it. Garbage comes on top until it is compacted,
+	// so the log can grow to MaxBytes/(1-CompactRatio).
+	MaxBytes int64
+	// Logger receives errors of the work done in the background of a
+	// successful Put, such as compaction. Nothing is logged by default.
+	Logger *slog.Logger
+}
+
+// location is where the latest value of a key lives in the log.
+type location struct {
+	offset int64 // offset of the record
+	size   int64 // size of the whole record
+	keyLen int64
+}
+
+// A Store is a log-structured key/value store. It is safe for concurrent use.
+type Store struct {
+	dir  string
+	opts Options
+
+	mu      sync.RWMutex // guards everything below; readers only need it shared
+	f       *os.File
+	size    int64 // bytes in the log
+	garbage int64 // bytes of overwritten and deleted records
+	index   map[string]location
+}
+
+// Open opens the store in dir, creating it if needed, and rebuilds the
+// index from the log. A record torn by a crash at the end of the log is
+// truncated away.
+func Open(dir string, opts *Options) (*Store, error) {
+	s := &Store{dir: dir, index: make(map[string]location)}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.CompactRatio == 0 {
+		s.opts.CompactRatio = 0.5
+	}
+	if s.opts.CompactMinSize == 0 {
+		s.opts.CompactMinSize = 1 << 20
+	}
+	if s.opts.Logger == nil {
+		s.opts.Logger = slog.New(slog.DiscardHandler)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	os.Remove(filepath.Join(dir, compactName)) // left over by an interrupted compaction
+
+	f, err := os.OpenFile(filepath.Join(dir, logName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.f = f
+	if err := s.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.evict() // MaxBytes may have been lowered since the log was written
+	return s, nil
+}
+
+// replay scans the log and rebuilds the index.
+func (s *Store) replay() error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, fi.Size()))
+	var offset int64
+	for {
+		flags, key, _, size, err := readRecord(r, fi.Size()-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// 日志末尾可能有一条写了一半的记录（进程崩溃），截掉它。
+			if err := s.f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		s.apply(string(key), flags, location{offset: offset, size: size, keyLen: int64(len(key))})
+		offset += size
+	}
+	s.size = offset
+	_, err = s.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// apply updates the index for a record that was appended at loc.
+func (s *Store) apply(key string, flags byte, loc location) {
+	if old, ok := s.index[key]; ok {
+		s.garbage += old.size
+		delete(s.index, key)
+	}
+	if flags&flagTombstone != 0 {
+		s.garbage += loc.size
+		return
+	}
+	s.index[key] = loc
+}
+
+// readRecord reads the next record from r, which has remaining bytes left.
+// A record claiming more than that is torn: its header is not checked
+// until the whole record is read, so its lengths can't be trusted.
+func readRecord(r io.Reader, remaining int64) (flags byte, key, value []byte, size int64, err error) {
+	var header [headerSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("disk: torn record header")
+		}
+		return
+	}
+	sum := binary.BigEndian.Uint32(header[0:4])
+	flags = header[4]
+	keyLen := binary.BigEndian.Uint32(header[5:9])
+	valueLen := binary.BigEndian.Uint32(header[9:13])
+	if int64(keyLen)+int64(valueLen) > remaining-headerSize {
+		err = errors.New("disk: torn record: lengths past the end of the log")
+		return
+	}
+
+	data := make([]byte, int(keyLen)+int(valueLen))
+	if _, err = io.ReadFull(r, data); err != nil {
+		err = fmt.Errorf("disk: torn record: %v", err)
+		return
+	}
+	h := crc32.NewIEEE()
+	h.Write(header[4:])
+	h.Write(data)
+	if h.Sum32() != sum {
+		err = errors.New("disk: record checksum mismatch")
+		return
+	}
+	return flags, data[:keyLen], data[keyLen:], int64(headerSize + len(data)), nil
+}
+
+func encodeRecord(flags byte, key string, value []byte) []byte {
+	buf := make([]byte, headerSize+len(key)+len(value))
+	buf[4] = flags
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[9:13], uint32(len(value)))
+	copy(buf[headerSize:], key)
+	copy(buf[headerSize+len(key):], value)
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// Put stores value under key, replacing any previous value.
+func (s *Store) Put(key string, value []byte) error {
+	if s.opts.MaxBytes > 0 && int64(headerSize+len(key)+len(value)) > s.opts.MaxBytes {
+		return ErrTooLarge
+	}
+	return s.append(0, key, value)
+}
+
+// Delete removes key from the store.
+func (s *Store) Delete(key string) error {
+	s.mu.RLock()
+	_, ok := s.index[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return s.append(flagTombstone, key, nil)
+}
+
+func (s *Store) append(flags byte, key string, value []byte) error {
+	rec := encodeRecord(flags, key, value)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return errors.New("disk: store is closed")
+	}
+	if err := s.write(rec); err != nil {
+		return err
+	}
+	s.apply(key, flags, location{offset: s.size, size: int64(len(rec)), keyLen: int64(len(key))})
+	s.size += int64(len(rec))
+
+	// 数据已经写进去了，后面的淘汰和压缩失败不影响这次写入，只记日志。
+	s.evict()
+	if s.opts.CompactRatio > 0 && s.size >= s.opts.CompactMinSize &&
+		float64(s.garbage) >= s.opts.CompactRatio*float64(s.size) {
+		if err := s.compact(); err != nil {
+			s.opts.Logger.Error("disk: compaction failed", "dir", s.dir, "error", err)
+		}
+	}
+	return nil
+}
+
+// write appends buf to the log. If that fails, whatever part of buf made
+// it to the file is cut off again, so the next record still lands at
+// s.size. s.mu must be held.
+func (s *Store) write(buf []byte) error {
+	if _, err := s.f.Write(buf); err != nil {
+		if terr := s.f.Truncate(s.size); terr != nil {
+			return errors.Join(err, terr)
+		}
+		if _, serr := s.f.Seek(s.size, io.SeekStart); serr != nil {
+			return errors.Join(err, serr)
+		}
+		return err
+	}
+	return nil
+}
+
+// evict deletes the oldest keys, in log order, until the live records
+// take at most 90% of MaxBytes, if they take more than MaxBytes.
+// s.mu must be held.
+func (s *Store) evict() {
+	if s.opts.MaxBytes <= 0 || s.size-s.garbage <= s.opts.MaxBytes {
+		return
+	}
+	keys := s.logOrder()
+
+	// 一次多淘汰一些，免得之后每次Put都要排序一遍。墓碑一次写完。
+	target := s.opts.MaxBytes / 10 * 9
+	live := s.size - s.garbage
+	var buf []byte
+	var victims []string
+	for _, key := range keys {
+		if live <= target {
+			break
+		}
+		live -= s.index[key].size
+		buf = append(buf, encodeRecord(flagTombstone, key, nil)...)
+		victims = append(victims, key)
+	}
+	if err := s.write(buf); err != nil {
+		s.opts.Logger.Error("disk: eviction failed", "dir", s.dir, "error", err)
+		return
+	}
+	for _, key := range victims {
+		size := int64(headerSize + len(key))
+		s.apply(key, flagTombstone, location{offset: s.size, size: size, keyLen: int64(len(key))})
+		s.size += size
+	}
+}
+
+// logOrder returns the keys in the index sorted by the offset of their
+// records, oldest first. s.mu must be held.
+func (s *Store) logOrder() []string {
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Compare(s.index[a].offset, s.index[b].offset)
+	})
+	return keys
+}
+
+// Get returns the value stored under key, or ErrNotFound.
+func (s *Store) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.f == nil {
+		return nil, errors.New("disk: store is closed")
+	}
+	loc, ok := s.index[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	rec := make([]byte, loc.size)
+	if _, err := s.f.ReadAt(rec, loc.offset); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(rec[0:4]) != crc32.ChecksumIEEE(rec[4:]) {
+		return nil, fmt.Errorf("disk: record of %q is corrupted", key)
+	}
+	return rec[headerSize+loc.keyLen:], nil
+}
+
+// Keys returns the keys in the store, in no particular order.
+func (s *Store) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.index))
+	for key := range s.index {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Len returns the number of keys in the store.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.index)
+}
+
+// Size returns the size of the log and how much of it is garbage.
+func (s *Store) Size() (size, garbage int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size, s.garbage
+}
+
+// Compact rewrites the log keeping only the live records.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return errors.New("disk: store is closed")
+	}
+	return s.compact()
+}
+
+// compact copies the live records into a new log and swaps it in. They
+// keep their order, which evict relies on. s.mu must be held.
+func (s *Store) compact() error {
+	path := filepath.Join(s.dir, compactName)
+	nf, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(nf)
+	index := make(map[string]location, len(s.index))
+	var offset int64
+	for _, key := range s.logOrder() {
+		loc := s.index[key]
+		rec := make([]byte, loc.size)
+		if _, err := s.f.ReadAt(rec, loc.offset); err != nil {
+			nf.Close()
+			os.Remove(path)
+			return err
+		}
+		w.Write(rec)
+		index[key] = location{offset: offset, size: loc.size, keyLen: loc.keyLen}
+		offset += loc.size
+	}
+	if err := w.Flush(); err != nil {
+		nf.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := nf.Sync(); err != nil {
+		nf.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := os.Rename(path, filepath.Join(s.dir, logName)); err != nil {
+		nf.Close()
+		os.Remove(path)
+		return err
+	}
+
+	s.f.Close()
+	s.f = nf
+	s.index = index
+	s.size = offset
+	s.garbage = 0
+	_, err = s.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Sync flushes the log to stable storage.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Sync()
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
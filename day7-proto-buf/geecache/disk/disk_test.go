@@ -0,0 +1,207 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPutGetDelete(t *testing.T) {
+	s, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Put("Tom", []byte("630"))
+	s.Put("Jack", []byte("589"))
+	s.Put("Tom", []byte("631"))
+	s.Delete("Jack")
+
+	if v, err := s.Get("Tom"); err != nil || string(v) != "631" {
+		t.Fatalf("Get(Tom) = %q, %v", v, err)
+	}
+	if _, err := s.Get("Jack"); err != ErrNotFound {
+		t.Fatalf("deleted key should be missing, got %v", err)
+	}
+	if s.Len() != 1 {
+		t.Fatalf("expect 1 key, but %d got", s.Len())
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, nil)
+	s.Put("Tom", []byte("630"))
+	s.Put("Sam", []byte("567"))
+	s.Delete("Sam")
+	s.Close()
+
+	// Simulate a crash in the middle of appending a record.
+	f, _ := os.OpenFile(filepath.Join(dir, logName), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(encodeRecord(0, "Jack", []byte("589"))[:10])
+	f.Close()
+
+	s, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.Get("Tom"); err != nil || string(v) != "630" {
+		t.Fatalf("Get(Tom) = %q, %v", v, err)
+	}
+	if _, err := s.Get("Sam"); err != ErrNotFound {
+		t.Fatal("Sam was deleted before the restart")
+	}
+
+	// The torn record is gone and new records are readable.
+	s.Put("Jack", []byte("589"))
+	if v, err := s.Get("Jack"); err != nil || string(v) != "589" {
+		t.Fatalf("Get(Jack) = %q, %v", v, err)
+	}
+}
+
+func TestTornLengths(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, nil)
+	s.Put("Tom", []byte("630"))
+	s.Close()
+
+	// A header whose lengths ran past the end of the log must not be
+	// trusted, or Open would try to allocate gigabytes for it.
+	header := encodeRecord(0, "Jack", []byte("589"))[:headerSize]
+	binary.BigEndian.PutUint32(header[5:9], 1<<31)
+	binary.BigEndian.PutUint32(header[9:13], 1<<31)
+	f, _ := os.OpenFile(filepath.Join(dir, logName), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(header)
+	f.Close()
+
+	s, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.Get("Tom"); err != nil || string(v) != "630" {
+		t.Fatalf("Get(Tom) = %q, %v", v, err)
+	}
+	if size, _ := s.Size(); size != int64(headerSize+len("Tom630")) {
+		t.Fatalf("torn header was not truncated, size=%d", size)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	s, _ := Open(t.TempDir(), &Options{CompactRatio: 0.5, CompactMinSize: 1024})
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		s.Put("key", []byte(strconv.Itoa(i)))
+	}
+	s.Put("other", []byte("value"))
+
+	// About 1.7KB was appended, so the log must have been compacted on the way.
+	if size, garbage := s.Size(); size >= 1024 {
+		t.Fatalf("expected automatic compaction, size=%d garbage=%d", size, garbage)
+	}
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if size, garbage := s.Size(); garbage != 0 || size != int64(2*headerSize+len("key99")+len("othervalue")) {
+		t.Fatalf("unexpected size after compaction: size=%d garbage=%d", size, garbage)
+	}
+	if v, err := s.Get("key"); err != nil || string(v) != "99" {
+		t.Fatalf("Get(key) = %q, %v", v, err)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	record := int64(headerSize + len("k0") + 10)
+	s, _ := Open(dir, &Options{MaxBytes: 10 * record})
+	for i := 0; i < 10; i++ {
+		s.Put("k"+strconv.Itoa(i), make([]byte, 10))
+	}
+	if s.Len() != 10 {
+		t.Fatalf("full store holds %d keys", s.Len())
+	}
+
+	// Going over evicts the oldest keys down to 90%.
+	s.Put("k0", make([]byte, 10)) // k0 becomes the newest
+	s.Put("kx", make([]byte, 10))
+	if _, err := s.Get("k1"); err != ErrNotFound {
+		t.Fatal("oldest key k1 was not evicted")
+	}
+	for _, k := range []string{"k0", "kx"} {
+		if _, err := s.Get(k); err != nil {
+			t.Fatalf("Get(%s) = %v", k, err)
+		}
+	}
+	if size, garbage := s.Size(); size-garbage > 9*record {
+		t.Fatalf("%d bytes live after eviction", size-garbage)
+	}
+	if err := s.Put("huge", make([]byte, 10*record)); err != ErrTooLarge {
+		t.Fatalf("Put of a value larger than the store = %v", err)
+	}
+	n := s.Len()
+	s.Close()
+
+	// Evicted keys stay evicted, and a lower limit applies on Open.
+	s, _ = Open(dir, &Options{MaxBytes: 5 * record})
+	defer s.Close()
+	if _, err := s.Get("k1"); err != ErrNotFound {
+		t.Fatal("evicted key k1 came back")
+	}
+	if s.Len() >= n || s.Len() > 5 {
+		t.Fatalf("%d keys left after reopening with a lower limit", s.Len())
+	}
+}
+
+func TestCompactionKeepsLogOrder(t *testing.T) {
+	record := int64(headerSize + len("k0") + 10)
+	s, _ := Open(t.TempDir(), &Options{MaxBytes: 10 * record, CompactRatio: -1})
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		s.Put("k"+strconv.Itoa(i), make([]byte, 10))
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compaction must not shuffle the records, or eviction would no
+	// longer pick the oldest keys.
+	s.Put("kx", make([]byte, 10))
+	for i := 0; i < 10; i++ {
+		_, err := s.Get("k" + strconv.Itoa(i))
+		if evicted := err == ErrNotFound; evicted != (i < 2) {
+			t.Fatalf("k%d evicted = %v", i, evicted)
+		}
+	}
+}
+
+func TestCompactionFailureLogged(t *testing.T) {
+	var buf bytes.Buffer
+	dir := t.TempDir()
+	s, _ := Open(dir, &Options{
+		CompactMinSize: 64,
+		Logger:         slog.New(slog.NewTextHandler(&buf, nil)),
+	})
+	defer s.Close()
+	os.RemoveAll(dir) // the open log is still writable, but no new log can be created
+
+	for i := 0; i < 10; i++ {
+		if err := s.Put("key", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Put failed because of the compaction: %v", err)
+		}
+	}
+	if !strings.Contains(buf.String(), "compaction failed") {
+		t.Fatalf("compaction failure not logged: %s", buf.String())
+	}
+	if v, err := s.Get("key"); err != nil || string(v) != "9" {
+		t.Fatalf("Get(key) = %q, %v", v, err)
+	}
+}
@@ -0,0 +1,33 @@
+package geecache
+
+// 内存放不下、但重新计算又很贵的值，被mainCache淘汰时先落到本地磁盘上（L2），
+// Get在去peer或slow DB之前会先查一下磁盘。
+
+import "geecache/disk"
+
+// WithDiskTier adds store as a second tier under mainCache: entries
+// evicted from mainCache for lack of room are written to store, and Get
+// looks there before asking peers or the getter. Values are written in
+// their stored form, so store holds them encoded with the group codec.
+// Keys deleted from the group, or owned by another peer, are removed from
+// store; give it a MaxBytes to bound it otherwise.
+func WithDiskTier(store *disk.Store) GroupOption {
+	return func(g *Group) {
+		g.disk = store
+	}
+}
+
+// spill writes an entry evicted from mainCache to the disk tier.
+func (g *Group) spill(key string, value ByteView) {
+	if err := g.disk.Put(key, value.bytes()); err != nil {
+		g.logger.Error("disk tier put failed", keyAttr(key), "error", err)
+	}
+}
+
+// unspill removes key from the disk tier, e.g. because it was deleted or
+// this node no longer owns it.
+func (g *Group) unspill(key string) {
+	if err := g.disk.Delete(key); err != nil {
+		g.logger.Error("disk tier delete failed", keyAttr(key), "error", err)
+	}
+}
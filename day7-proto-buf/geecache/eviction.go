@@ -0,0 +1,44 @@
+package geecache
+
+// 应用有时需要知道自己的数据什么时候、为什么离开了缓存（比如清理关联的资源、打点）。
+// 监听器在cache的锁外调用，监听器里再调用Group.Get也不会死锁。
+
+// WithEvictionListener makes the group call fn for every entry that
+// leaves its mainCache or hotCache, with the value as the getter returned
+// it and the reason it left. It may be given more than once.
+func WithEvictionListener(fn func(key string, value ByteView, reason EvictionReason)) GroupOption {
+	return func(g *Group) {
+		g.evictionListeners = append(g.evictionListeners, fn)
+	}
+}
+
+// evicted is the eviction callback of mainCache.
+func (g *Group) evicted(key string, value ByteView, reason EvictionReason) {
+	// 只有放不下的才落盘；删掉的、过期的、被覆盖的落盘就是脏数据，磁盘上要是有旧的一份也得删掉。
+	if g.disk != nil {
+		if reason == EvictCapacity || reason == EvictResized {
+			g.spill(key, value)
+		} else {
+			g.unspill(key)
+		}
+	}
+	g.notifyEvicted(key, value, reason)
+}
+
+// notifyEvicted calls the observers and the eviction listeners.
+func (g *Group) notifyEvicted(key string, value ByteView, reason EvictionReason) {
+	for _, o := range g.observers {
+		o.Evict(g.name, key, reason)
+	}
+	if len(g.evictionListeners) == 0 {
+		return
+	}
+	v, err := g.decode(value)
+	if err != nil {
+		g.logger.Error("decoding evicted value", keyAttr(key), "error", err)
+		return
+	}
+	for _, fn := range g.evictionListeners {
+		fn(key, v, reason)
+	}
+}
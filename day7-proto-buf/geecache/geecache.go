@@ -1,20 +1,79 @@
 package geecache
 
 import (
+	"context"
 	"fmt"
+	"geecache/compress"
+	"geecache/disk"
 	pb "geecache/geecachepb"
 	"geecache/singleflight"
-	"log"
+	"geecache/tracing"
+	"log/slog"
+	"math/rand"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // A Group is a cache namespace and associated data loaded spread over
 type Group struct {
 	name      string
 	getter    Getter // 会为每一个cache server 配置一个getter用来查询指定的slowDB（这是用于缓存中查不到数据的时候指明应该从哪里获取数据）
-	mainCache cache
-	peers     PeerPicker          // HTTPPool实现了PeerPicker接口。实际使用中，先创建Group，再创建peers，随后才开启HTTPServer。
-	loader    *singleflight.Group // 只有一个实例，所有共享这一个实例。
+	mainCache Cache
+	// hotCache holds copies of keys owned by other peers that are expensive
+	// to fetch again, e.g. hot keys owned by a peer in another zone.
+	hotCache Cache
+	peers    PeerPicker          // HTTPPool实现了PeerPicker接口。实际使用中，先创建Group，再创建peers，随后才开启HTTPServer。
+	loader   *singleflight.Group // 只有一个实例，所有共享这一个实例。
+	// peerLoader dedups loads for requests forwarded by other peers. It is
+	// separate from loader so a peer request never waits on one of our own
+	// forwards; two nodes forwarding the same key to each other would
+	// otherwise wait on each other forever.
+	peerLoader *singleflight.Group
+
+	disk         *disk.Store    // second tier under mainCache, see WithDiskTier
+	codec        compress.Codec // values are stored encoded with codec, see WithCompression
+	maxValueSize int64          // see WithMaxValueSize
+
+	memoryLimit   int64  // see WithMemoryLimit
+	memoryChecked int64  // when checkMemory last read the heap size, unix nano
+	memoryGC      uint64 // GC cycle in which checkMemory last evicted
+
+	sizeFloor, sizeCeiling int64 // bounds of the cache budget, see WithAdaptiveSize
+
+	evictionListeners []func(key string, value ByteView, reason EvictionReason) // see WithEvictionListener
+	observers         []Observer                                                // see WithObserver
+	logger            *slog.Logger                                              // see WithLogger
+	tracer            *tracing.Tracer                                           // see WithTracer
+
+	snapshotDir      string        // see WithSnapshotDir
+	snapshotInterval time.Duration // how often mainCache is written to snapshotDir
+	snapshotStop     chan struct{} // closed by StopSnapshots
+	snapshotDone     chan struct{} // closed once the snapshot goroutine has returned
+	snapshotOnce     sync.Once
+
+	// Stats are statistics on the values this group stores.
+	Stats Stats
+}
+
+// Stats are per-group statistics.
+type Stats struct {
+	RawBytes    AtomicInt // size of the values loaded by the getter, before encoding
+	StoredBytes AtomicInt // size of the same values once encoded with the group codec
+	// MemoryEvictions counts entries evicted because the heap was above
+	// the memory limit, see WithMemoryLimit.
+	MemoryEvictions AtomicInt
+}
+
+// CompressionRatio returns how many times smaller the codec made the
+// values loaded so far, or 1 if nothing was loaded yet.
+func (s *Stats) CompressionRatio() float64 {
+	stored := s.StoredBytes.Get()
+	if stored == 0 {
+		return 1
+	}
+	return float64(s.RawBytes.Get()) / float64(stored)
 }
 
 // A Getter loads data for a key.
@@ -38,24 +97,67 @@ var (
 
 // NewGroup create a new instance of Group
 // 创建一个新的group（cacheserver）
-func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
+func NewGroup(name string, cacheBytes int64, getter Getter, opts ...GroupOption) *Group {
 	if getter == nil { // 必须配置一个getter用来告诉数据如果没有的时候应该向哪里要
 		panic("nil Getter")
 	}
 
-	mu.Lock()
-	defer mu.Unlock() // 下面的 groups[name] 是共享数据 要上锁
-
 	g := &Group{
-		name:      name,
-		getter:    getter,
-		mainCache: cache{cacheBytes: cacheBytes},
-		loader:    &singleflight.Group{},
+		name:       name,
+		getter:     getter,
+		mainCache:  Cache{cacheBytes: cacheBytes},
+		hotCache:   Cache{cacheBytes: cacheBytes / 8},
+		loader:     &singleflight.Group{},
+		peerLoader: &singleflight.Group{},
+		codec:      compress.None,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.sizeCeiling > 0 {
+		g.resize(min(max(g.CacheBytes(), g.sizeFloor), g.sizeCeiling)) // 等其他选项都生效后再定初始大小
+	}
+	if g.logger == nil {
+		g.logger = quietLogger
+	}
+	g.logger = g.logger.With("group", name)
+	notify := len(g.evictionListeners) > 0 || len(g.observers) > 0
+	if g.disk != nil || notify {
+		g.mainCache.onEvicted = g.evicted
 	}
+	if notify {
+		g.hotCache.onEvicted = g.notifyEvicted
+	}
+	if g.snapshotDir != "" {
+		g.startSnapshots()
+	}
+
+	mu.Lock()
+	defer mu.Unlock() // 下面的 groups[name] 是共享数据 要上锁
 	groups[name] = g
 	return g
 }
 
+// A GroupOption configures a Group.
+type GroupOption func(*Group)
+
+// AtomicInt is an int64 to be accessed atomically.
+type AtomicInt int64
+
+// Add atomically adds n to i.
+func (i *AtomicInt) Add(n int64) {
+	atomic.AddInt64((*int64)(i), n)
+}
+
+// Get atomically gets the value of i.
+func (i *AtomicInt) Get() int64 {
+	return atomic.LoadInt64((*int64)(i))
+}
+
+func (i *AtomicInt) String() string {
+	return strconv.FormatInt(i.Get(), 10)
+}
+
 // GetGroup returns the named group previously created with NewGroup, or
 // nil if there's no such group.
 func GetGroup(name string) *Group {
@@ -65,84 +167,308 @@ func GetGroup(name string) *Group {
 	return g
 }
 
-// RegisterPeers registers a PeerPicker for choosing remote peer
+// groupsUsing returns the groups that pick their peers with peers.
+func groupsUsing(peers PeerPicker) []*Group {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var gs []*Group
+	for _, g := range groups {
+		if g.peers == peers {
+			gs = append(gs, g)
+		}
+	}
+	return gs
+}
+
+// RegisterPeers registers a PeerPicker for choosing remote peer.
+// Cached keys owned by another peer, e.g. restored from a snapshot taken
+// before the ring changed, are dropped.
 func (g *Group) RegisterPeers(peers PeerPicker) {
 	if g.peers != nil {
 		panic("RegisterPeerPicker called more than once")
 	}
 	g.peers = peers
+
+	for _, key := range g.mainCache.Keys() {
+		if !g.owns(key) {
+			g.mainCache.Delete(key)
+		}
+	}
+	if g.disk != nil {
+		for _, key := range g.disk.Keys() {
+			if !g.owns(key) {
+				g.unspill(key)
+			}
+		}
+	}
+}
+
+// Delete removes key from this node's caches, the disk tier included.
+// Copies held by other peers are not affected.
+func (g *Group) Delete(key string) {
+	g.mainCache.Delete(key)
+	g.hotCache.Delete(key)
+	if g.disk != nil {
+		g.unspill(key)
+	}
+}
+
+// An ownerChecker is a PeerPicker that can tell whether this node owns a
+// key without the side effects of PickPeer, e.g. counting the pick.
+type ownerChecker interface {
+	Owns(key string) bool
+}
+
+// owns reports whether this node owns key, i.e. no peer is picked for it.
+func (g *Group) owns(key string) bool {
+	if g.peers == nil {
+		return true
+	}
+	if oc, ok := g.peers.(ownerChecker); ok {
+		return oc.Owns(key)
+	}
+	_, remote := g.peers.PickPeer(key)
+	return !remote
 }
 
 // Get value for a key from cache
 // 调用一个group的Get，就是获取这个group里面的键key对应的值v。
 // 获取v有多种情况：1.可以在本group里面直接找到key，那么直接返回即可。2.本地没有key，则去远程的peers（其他group）去找key。3.通过提供的getter函数去找key。难易度是从高到低提升的。
 func (g *Group) Get(key string) (ByteView, error) {
+	var v ByteView
+	if err := g.GetInto(context.Background(), key, ByteViewSink(&v)); err != nil {
+		return ByteView{}, err
+	}
+	return v, nil
+}
+
+// GetInto fills dest with the value of key. When the value has to be
+// loaded and the getter is a SinkGetter, the getter fills dest itself,
+// so e.g. a ProtoSink receives the getter's message without another
+// round of decoding. ctx is passed on to the SinkGetter.
+func (g *Group) GetInto(ctx context.Context, key string, dest Sink) (err error) {
+	ctx, span := g.startSpan(ctx, "geecache.Get", key)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	v, destPopulated, err := g.get(ctx, key, false, dest)
+	if err != nil {
+		return err
+	}
+	if destPopulated {
+		return nil
+	}
+	if v, err = g.decode(v); err != nil {
+		return err
+	}
+	return dest.setView(v)
+}
+
+// get returns the stored form of the value of key, i.e. encoded with
+// g.codec. mainCache, hotCache, the disk tier and load all deal in the
+// stored form; only GetInto decodes it. If the getter loaded the value
+// into dest, which may be nil, destPopulated is true.
+//
+// fromPeer is set for requests another peer already forwarded to us. They
+// only consult the local caches and the getter and are never forwarded
+// again, so peers that disagree about the ring can't bounce a key back and
+// forth between them.
+func (g *Group) get(ctx context.Context, key string, fromPeer bool, dest Sink) (value ByteView, destPopulated bool, err error) {
 	if key == "" {
-		return ByteView{}, fmt.Errorf("key is required")
+		return ByteView{}, false, fmt.Errorf("key is required")
 	}
 
-	if v, ok := g.mainCache.get(key); ok {
-		log.Println("[GeeCache] hit")
-		return v, nil
+	if v, ok := g.lookupCache(key); ok {
+		if g.logger.Enabled(ctx, slog.LevelDebug) {
+			g.logger.Debug("hit", keyAttr(key), "from_peer", fromPeer)
+		}
+		for _, o := range g.observers {
+			o.Hit(g.name, key)
+		}
+		return v, false, nil
+	}
+	if g.logger.Enabled(ctx, slog.LevelDebug) {
+		g.logger.Debug("miss", keyAttr(key), "from_peer", fromPeer)
+	}
+	for _, o := range g.observers {
+		o.Miss(g.name, key)
 	}
 
-	return g.load(key) // 如果本地找不到，就调用load去远程调用
+	return g.load(ctx, key, fromPeer, dest) // 如果本地找不到，就调用load去远程调用
 }
 
 // 1.去远程的peers的cache找key 2.去远程的slow DB找key。
-func (g *Group) load(key string) (value ByteView, err error) {
+// fromPeer为true时说明请求已经被别的peer转发过一次，此时不能再转发。
+func (g *Group) load(ctx context.Context, key string, fromPeer bool, dest Sink) (value ByteView, destPopulated bool, err error) {
+	ctx, span := g.startSpan(ctx, "geecache.load", key)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 
 	// load 完全有可能同时被多个请求同时调用。如果同时调用，就可能引起“缓存击穿”的问题。
 	// 下面的Do函数是为了解决“缓存击穿”问题。
-	viewi, err := g.loader.Do(key, func() (interface{}, error) { // g.loader只有一个，大家都共享这一个实例
-		if g.peers != nil { // g.peers里面有全部的cache server ip+port
+	loader := g.loader
+	if fromPeer {
+		loader = g.peerLoader
+	}
+	viewi, err, shared := loader.Do(key, func() (interface{}, error) { // g.loader只有一个，大家都共享这一个实例
+		if g.peers != nil && !fromPeer { // g.peers里面有全部的cache server ip+port
 			if peer, ok := g.peers.PickPeer(key); ok { // 根据key找到下一个cache server
-				if value, err = g.getFromPeer(peer, key); err == nil {
+				start := time.Now()
+				value, err = g.getFromPeer(ctx, peer, key)
+				g.observePeer(key, peer, time.Since(start), err)
+				if err == nil {
+					if g.logger.Enabled(ctx, slog.LevelDebug) {
+						g.logger.Debug("loaded from peer", keyAttr(key), "peer", peerName(peer), "latency", time.Since(start))
+					}
+					// 和groupcache一样随机挑一部分放进hotCache：越热的key被拷贝的机会越大。
+					if hc, ok := peer.(hotCopier); ok && hc.keepLocalCopy() && rand.Intn(10) == 0 {
+						g.hotCache.add(key, value)
+					}
 					return value, nil
 				} // 再看key是否在这个server上面。“如果有，则一定在这个server上面”
-				log.Println("[GeeCache] Failed to get from peer", err)
+				if _, ok := err.(*ValueTooLargeError); ok {
+					return nil, err // 本地再加载一遍也还是太大
+				}
+				g.logger.Warn("peer get failed", keyAttr(key), "peer", peerName(peer), "latency", time.Since(start), "error", err)
 			}
 		}
 
-		return g.getLocally(key) // 所有的peer的cache里面都没有想要的cache，最后只有到slow DB去找了。
+		start := time.Now()
+		value, err := g.getLocally(ctx, key, dest) // 所有的peer的cache里面都没有想要的cache，最后只有到slow DB去找了。
+		latency := time.Since(start)
+		if err != nil {
+			g.logger.Warn("load failed", keyAttr(key), "latency", latency, "error", err)
+			for _, o := range g.observers {
+				o.LoadError(g.name, key, err)
+			}
+			return nil, err
+		}
+		if g.logger.Enabled(ctx, slog.LevelDebug) {
+			g.logger.Debug("loaded", keyAttr(key), "latency", latency)
+		}
+		for _, o := range g.observers {
+			o.LocalLoad(g.name, key, latency)
+		}
+		destPopulated = dest != nil // 只有真正执行了这个函数的调用方，dest才被填过
+		return value, nil
 	})
 
+	span.SetAttr("dedup", strconv.FormatBool(shared)) // 等的是别人的加载，时间花在singleflight上
+	if shared {
+		for _, o := range g.observers {
+			o.Dedup(g.name, key)
+		}
+	}
 	if err == nil {
-		return viewi.(ByteView), nil
+		return viewi.(ByteView), destPopulated, nil
 	}
 	return
 }
 
+func (g *Group) observePeer(key string, peer PeerGetter, latency time.Duration, err error) {
+	if len(g.observers) == 0 {
+		return
+	}
+	name := peerName(peer)
+	for _, o := range g.observers {
+		if err != nil {
+			o.PeerError(g.name, key, name, err)
+		} else {
+			o.PeerLoad(g.name, key, name, latency)
+		}
+	}
+}
+
+// lookupCache looks key up in mainCache, then in hotCache, then on disk.
+// A value found on disk is moved back into mainCache. The disk tier only
+// serves keys this node owns.
+func (g *Group) lookupCache(key string) (ByteView, bool) {
+	if v, ok := g.mainCache.Get(key); ok {
+		return v, true
+	}
+	if v, ok := g.hotCache.Get(key); ok {
+		return v, true
+	}
+	if g.disk == nil {
+		return ByteView{}, false
+	}
+	if !g.owns(key) {
+		g.unspill(key) // 环变了之后别的节点才是主人，磁盘上这份可能已经旧了
+		return ByteView{}, false
+	}
+
+	b, err := g.disk.Get(key)
+	if err != nil {
+		if err != disk.ErrNotFound {
+			g.logger.Error("disk tier get failed", keyAttr(key), "error", err)
+		}
+		return ByteView{}, false
+	}
+	v := ByteView{b: b}
+	g.populateCache(key, v)
+	return v, true
+}
+
 // 填充缓存
 func (g *Group) populateCache(key string, value ByteView) {
 	g.mainCache.add(key, value)
+	if g.memoryLimit > 0 {
+		g.checkMemory()
+	}
 }
 
 // 找slow DB -- 将找到的key加入cache中 -- 返回key
-func (g *Group) getLocally(key string) (ByteView, error) {
-	bytes, err := g.getter.Get(key) // 用创建group伊始时传进来的Getter来找数据。（在slowDB里面找，getter本来就是用来在找不到数据的时候到slowDB里面找数据的）
+// dest不为nil时，getter直接把值填进dest。
+func (g *Group) getLocally(ctx context.Context, key string, dest Sink) (_ ByteView, err error) {
+	ctx, span := g.startSpan(ctx, "geecache.getLocally", key)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	raw, err := g.getterValue(ctx, key, dest) // 用创建group伊始时传进来的Getter来找数据。（在slowDB里面找，getter本来就是用来在找不到数据的时候到slowDB里面找数据的）
 	if err != nil {
 		return ByteView{}, err
 
 	}
 
-	value := ByteView{b: cloneBytes(bytes)}
+	value, err := g.encode(raw)
+	if err != nil {
+		return ByteView{}, err
+	}
 
 	g.populateCache(key, value)
 
 	return value, nil
 }
 
-func (g *Group) getFromPeer(peer PeerGetter, key string) (ByteView, error) {
+func (g *Group) getFromPeer(ctx context.Context, peer PeerGetter, key string) (_ ByteView, err error) {
+	ctx, span := g.startSpan(ctx, "geecache.getFromPeer", key)
+	span.SetAttr("peer", peerName(peer))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	req := &pb.Request{
-		Group: g.name,
-		Key:   key,
+		Group:        g.name,
+		BinaryKey:    []byte(key),
+		MaxValueSize: g.maxValueSize,
 	}
 	res := &pb.Response{}
 
-	err := peer.Get(req, res)
+	if cp, ok := peer.(ContextPeerGetter); ok {
+		err = cp.GetContext(ctx, req, res)
+	} else {
+		err = peer.Get(req, res)
+	}
 	if err != nil {
 		return ByteView{}, err
 	}
-	return ByteView{b: res.Value}, nil
+	return g.transcode(key, res.Value, res.Codec)
 }
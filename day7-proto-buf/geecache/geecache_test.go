@@ -0,0 +1,1471 @@
+package geecache
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"geecache/compress"
+	"geecache/consistenthash"
+	"geecache/discovery"
+	"geecache/disk"
+	pb "geecache/geecachepb"
+	"geecache/tracing"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var db = map[string]string{
+	"Tom":  "630",
+	"Jack": "589",
+	"Sam":  "567",
+}
+
+// newTestGroup creates a group backed by db that counts getter calls.
+func newTestGroup(name string, loads *int64) *Group {
+	return NewGroup(name, 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			atomic.AddInt64(loads, 1)
+			if v, ok := db[key]; ok {
+				return []byte(v), nil
+			}
+			return nil, fmt.Errorf("%s not exist", key)
+		}))
+}
+
+// handlerFunc lets a test start an httptest server before its pool exists.
+type handlerFunc struct{ h http.Handler }
+
+func (f *handlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) { f.h.ServeHTTP(w, r) }
+
+func TestPeerRequestNotForwarded(t *testing.T) {
+	var loads int64
+	gee := newTestGroup("loop", &loads)
+
+	ha, hb := &handlerFunc{}, &handlerFunc{}
+	a, b := httptest.NewServer(ha), httptest.NewServer(hb)
+	defer a.Close()
+	defer b.Close()
+
+	// The two nodes disagree about the ring: each one thinks the other owns
+	// every key. Without loop protection the request would bounce forever.
+	poolA, poolB := NewHTTPPool(a.URL), NewHTTPPool(b.URL)
+	poolA.Set(b.URL)
+	poolB.Set(a.URL)
+	ha.h, hb.h = poolA, poolB
+	gee.RegisterPeers(poolA)
+
+	view, err := gee.Get("Tom")
+	if err != nil || view.String() != db["Tom"] {
+		t.Fatalf("Get(Tom) = %q, %v", view.String(), err)
+	}
+	if loads != 1 {
+		t.Fatalf("expected 1 load from the getter, got %d", loads)
+	}
+	if poolB.Stats.PeerRequests.Get() != 1 {
+		t.Fatalf("expected node b to serve 1 peer request, got %d", poolB.Stats.PeerRequests.Get())
+	}
+	if poolA.Stats.RingMismatches.Get() == 0 || poolB.Stats.RingMismatches.Get() == 0 {
+		t.Fatalf("ring mismatch not reported: a=%d b=%d",
+			poolA.Stats.RingMismatches.Get(), poolB.Stats.RingMismatches.Get())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	pool := NewHTTPPool("http://localhost:8001")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := pool.Watch(ctx, discovery.NewStatic("http://localhost:8002")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pool.PickPeer("Tom"); !ok {
+		t.Fatal("the only peer should own every key")
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	gee := NewGroup("handoff", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			return []byte("v" + key), nil
+		}))
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	received := make(chan *pb.TransferRequest, 10)
+	newOwner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := &pb.TransferRequest{}
+		proto.Unmarshal(body, req)
+		received <- req
+		body, _ = proto.Marshal(&pb.TransferResponse{Accepted: int64(len(req.Entries))})
+		w.Write(body)
+	}))
+	defer newOwner.Close()
+
+	self := "http://localhost:8001"
+	// A rate this high rounds the interval between batches down to zero.
+	pool := NewHTTPPool(self, WithHandoff(HandoffOptions{BatchSize: 1, Rate: 2_000_000_000}))
+	pool.Set(self)
+	gee.RegisterPeers(pool)
+	for _, k := range keys {
+		gee.Get(k)
+	}
+
+	pool.Set(self, newOwner.URL)
+
+	expect := make(map[string]bool)
+	for _, k := range keys {
+		if _, ok := pool.PickPeer(k); ok {
+			expect[k] = true
+		}
+	}
+	if len(expect) == 0 {
+		t.Fatal("expected the new owner to take over some keys")
+	}
+	got := make(map[string]bool)
+	for len(got) < len(expect) {
+		select {
+		case req := <-received:
+			if req.Group != "handoff" {
+				t.Fatalf("unexpected group %s", req.Group)
+			}
+			for _, e := range req.Entries {
+				if string(e.Value) != "v"+string(e.Key) {
+					t.Fatalf("bad value for %s: %s", e.Key, e.Value)
+				}
+				got[string(e.Key)] = true
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expect keys %v to be handed off, but %v got", expect, got)
+		}
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect keys %v to be handed off, but %v got", expect, got)
+	}
+}
+
+func TestServeTransfer(t *testing.T) {
+	var loads int64
+	gee := newTestGroup("transfer", &loads)
+	// Both nodes own every key. httptest requests come from 192.0.2.1.
+	self, other := "http://localhost:8001", "http://192.0.2.1:8002"
+	pool := NewHTTPPool(self, WithReplication(2))
+	pool.Set(self, other)
+	gee.RegisterPeers(pool)
+
+	body, _ := proto.Marshal(&pb.TransferRequest{
+		Group:   "transfer",
+		Entries: []*pb.Entry{{Key: []byte("Tom"), Value: []byte("630")}},
+	})
+	transfer := func(from, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, defaultBasePath+transferPath, bytes.NewReader(body))
+		if from != "" {
+			req.Header.Set(fromPeerHeader, from)
+		}
+		if remote != "" {
+			req.RemoteAddr = remote
+		}
+		w := httptest.NewRecorder()
+		pool.ServeHTTP(w, req)
+		return w
+	}
+
+	// Without signing, only peers in the ring may hand off keys.
+	for _, c := range []struct{ from, remote string }{
+		{"", ""},
+		{"http://192.0.2.9:8002", "192.0.2.9:1234"}, // not in the ring
+		{other, "198.51.100.7:1234"},                // claims to be a peer
+	} {
+		if w := transfer(c.from, c.remote); w.Code != http.StatusForbidden {
+			t.Fatalf("transfer from %q at %q got %d", c.from, c.remote, w.Code)
+		}
+	}
+	if _, ok := gee.mainCache.Get("Tom"); ok {
+		t.Fatal("rejected transfer was cached")
+	}
+
+	if w := transfer(other, ""); w.Code != http.StatusOK {
+		t.Fatalf("transfer failed: %d %s", w.Code, w.Body)
+	}
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "630" || loads != 0 {
+		t.Fatalf("handed off key should be served from cache, got %q %v after %d loads", view.String(), err, loads)
+	}
+	if pool.Stats.SameZonePicks.Get()+pool.Stats.CrossZonePicks.Get() != 0 {
+		t.Fatal("ownership checks were counted as picks")
+	}
+}
+
+func TestOwnershipChangeReplicas(t *testing.T) {
+	prev, next := consistenthash.New(defaultReplicas, nil), consistenthash.New(defaultReplicas, nil)
+	prev.Add("a", "b", "c")
+	next.Add("a", "b", "c", "d")
+	c := OwnershipChange{Self: "a", Prev: prev, Next: next, Replication: 2}
+
+	var moved int
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		from, to, ok := c.Moved(key)
+		if want := !slices.Equal(prev.GetN(key, 2), next.GetN(key, 2)); ok != want {
+			t.Fatalf("Moved(%s) = %v", key, ok)
+		}
+		if !ok {
+			continue
+		}
+		moved++
+		// d only ever gains keys, and takes the place of an old replica.
+		if !reflect.DeepEqual(to, []string{"d"}) || len(from) != 1 || slices.Contains(next.GetN(key, 2), from[0]) {
+			t.Fatalf("Moved(%s) = %v, %v", key, from, to)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no key moved to d")
+	}
+}
+
+func TestPickPeerPrefersZone(t *testing.T) {
+	pool := NewHTTPPool("http://a", WithZone("z1"), WithReplication(3))
+	pool.Set("http://b", "http://c", "http://d")
+	pool.SetZones(map[string]string{"http://b": "z2", "http://c": "z1", "http://d": "z2"})
+
+	for k := range db {
+		peer, ok := pool.PickPeer(k)
+		if !ok || peer.(*httpGetter).baseURL != "http://c"+defaultBasePath {
+			t.Fatalf("expect %s to be fetched from the replica in our zone", k)
+		}
+	}
+	if pool.Stats.SameZonePicks.Get() != int64(len(db)) || pool.Stats.CrossZonePicks.Get() != 0 {
+		t.Fatalf("unexpected zone stats: same=%v cross=%v", &pool.Stats.SameZonePicks, &pool.Stats.CrossZonePicks)
+	}
+}
+
+func TestZoneCopies(t *testing.T) {
+	var fetches int64
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		body, _ := proto.Marshal(&pb.Response{Value: []byte("630")})
+		w.Write(body)
+	}))
+	defer remote.Close()
+
+	var loads int64
+	gee := newTestGroup("zone-copies", &loads)
+	pool := NewHTTPPool("http://localhost:8001", WithZone("z1"), WithZoneCopies())
+	pool.Set(remote.URL)
+	pool.SetZones(map[string]string{remote.URL: "z2"})
+	gee.RegisterPeers(pool)
+
+	// The key is hot: sooner or later a copy is kept and the remote zone is no longer asked.
+	for i := 0; i < 500; i++ {
+		if view, err := gee.Get("Tom"); err != nil || view.String() != "630" {
+			t.Fatalf("Get(Tom) = %q, %v", view.String(), err)
+		}
+	}
+	if n := atomic.LoadInt64(&fetches); n >= 500 {
+		t.Fatalf("hot key was never copied into our zone")
+	}
+	if pool.Stats.CrossZonePicks.Get() == 0 || pool.Stats.CrossZoneBytes.Get() == 0 {
+		t.Fatal("cross-zone traffic not counted")
+	}
+}
+
+// remotePicker claims that the listed keys are owned by another peer.
+type remotePicker map[string]bool
+
+func (p remotePicker) PickPeer(key string) (PeerGetter, bool) {
+	if p[key] {
+		return &httpGetter{baseURL: "http://remote" + defaultBasePath}, true
+	}
+	return nil, false
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	var loads int64
+	src := newTestGroup("snapshot-src", &loads)
+	for k := range db {
+		src.Get(k)
+	}
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// A node that no longer owns Jack must not restore it.
+	loads = 0
+	dst := newTestGroup("snapshot-dst", &loads)
+	dst.RegisterPeers(remotePicker{"Jack": true})
+	if err := dst.Restore(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"Tom", "Sam"} {
+		if view, err := dst.Get(k); err != nil || view.String() != db[k] {
+			t.Fatalf("Get(%s) = %q, %v", k, view.String(), err)
+		}
+	}
+	if loads != 0 {
+		t.Fatalf("restored keys should not be loaded again, got %d loads", loads)
+	}
+	if _, ok := dst.mainCache.Get("Jack"); ok {
+		t.Fatal("Jack is owned by another peer and should have been skipped")
+	}
+
+	corrupt := bytes.Clone(data)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if err := newTestGroup("snapshot-bad", &loads).Restore(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("corrupted snapshot should be rejected")
+	}
+}
+
+func TestSnapshotExpiry(t *testing.T) {
+	var loads int64
+	src := newTestGroup("snapshot-ttl-src", &loads)
+	src.mainCache.SetWithTTL("Tom", []byte("630"), time.Hour)
+	src.mainCache.SetWithTTL("Jack", []byte("589"), 20*time.Millisecond)
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestGroup("snapshot-ttl-dst", &loads)
+	time.Sleep(30 * time.Millisecond)
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, expires, ok := dst.mainCache.peek("Tom"); !ok || expires == 0 {
+		t.Fatalf("Tom should be restored with its expiry, got %d, %v", expires, ok)
+	}
+	if _, ok := dst.mainCache.Get("Jack"); ok {
+		t.Fatal("Jack expired before the restore and should have been skipped")
+	}
+}
+
+func TestSnapshotDir(t *testing.T) {
+	dir := t.TempDir()
+	var loads int64
+	before := newTestGroup("snapshot-dir", &loads)
+	before.snapshotDir = dir
+	for k := range db {
+		before.Get(k)
+	}
+	if err := before.writeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The node restarts: the new group comes up warm.
+	loads = 0
+	after := NewGroup("snapshot-dir", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return nil, fmt.Errorf("%s not exist", key)
+	}), WithSnapshotDir(dir, 0))
+	for k, v := range db {
+		if view, err := after.Get(k); err != nil || view.String() != v {
+			t.Fatalf("Get(%s) = %q, %v", k, view.String(), err)
+		}
+	}
+	if loads != 0 {
+		t.Fatalf("expected a warm restart, got %d loads", loads)
+	}
+
+	// The ring is only known once peers are registered.
+	after.RegisterPeers(remotePicker{"Jack": true})
+	if _, ok := after.mainCache.Get("Jack"); ok {
+		t.Fatal("restored Jack is owned by another peer and should have been dropped")
+	}
+}
+
+func TestStopSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	var loads int64
+	gee := NewGroup("snapshot-stop", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(db[key]), nil
+	}), WithSnapshotDir(dir, time.Hour))
+	gee.Get("Tom")
+	if err := gee.StopSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-gee.snapshotDone:
+	default:
+		t.Fatal("snapshot goroutine still running")
+	}
+	if err := gee.StopSnapshots(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last snapshot was written on the way out.
+	f, err := os.Open(gee.snapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dst := newTestGroup("snapshot-stop-dst", &loads)
+	if err := dst.Restore(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dst.mainCache.Get("Tom"); !ok {
+		t.Fatal("the last snapshot lacks Tom")
+	}
+}
+
+func TestSnapshotRecordLimit(t *testing.T) {
+	src := NewGroup("snapshot-limit-src", 8<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, nil
+	}))
+	src.mainCache.Set("big", bytes.Repeat([]byte("x"), 4096))
+	var buf bytes.Buffer
+	src.Snapshot(&buf)
+
+	dst := NewGroup("snapshot-limit-dst", 8<<10, GetterFunc(func(key string) ([]byte, error) {
+		return nil, nil
+	}), WithMaxValueSize(1024))
+	if err := dst.Restore(bytes.NewReader(buf.Bytes())); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("record over the max value size got %v", err)
+	}
+
+	// A corrupted length claiming an almost 1GB record fails once the data
+	// runs out, without allocating it.
+	corrupt := []byte(snapshotMagic + "\x00\x02\x00\x01\x01k\xff\xff\xff\xff\x03")
+	if err := src.Restore(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("truncated snapshot was accepted")
+	}
+}
+
+func TestDiskTier(t *testing.T) {
+	store, err := disk.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var loads int64
+	// Room for a single entry only: every new key evicts the previous one to disk.
+	gee := NewGroup("disk-tier", 8, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			if v, ok := db[key]; ok {
+				return []byte(v), nil
+			}
+			return nil, fmt.Errorf("%s not exist", key)
+		}), WithDiskTier(store))
+
+	for k := range db {
+		gee.Get(k)
+	}
+	if store.Len() != len(db)-1 {
+		t.Fatalf("expect %d keys spilled to disk, but %d got", len(db)-1, store.Len())
+	}
+	for k, v := range db {
+		if view, err := gee.Get(k); err != nil || view.String() != v {
+			t.Fatalf("Get(%s) = %q, %v", k, view.String(), err)
+		}
+	}
+	if loads != int64(len(db)) {
+		t.Fatalf("evicted keys should come back from disk, got %d loads", loads)
+	}
+
+	// Deleted keys are gone from disk too.
+	for k := range db {
+		gee.Delete(k)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("deleted keys left on disk: %v", store.Keys())
+	}
+	gee.Get("Tom")
+	gee.Get("Jack") // spills Tom
+	if loads != int64(len(db))+2 || store.Len() != 1 {
+		t.Fatalf("deleted keys should be loaded again, got %d loads, %d keys on disk", loads, store.Len())
+	}
+
+	// So are the keys that another peer owns.
+	gee.RegisterPeers(funcPicker(func(key string) (PeerGetter, bool) {
+		return peerFunc(func(in *pb.Request, out *pb.Response) error {
+			out.Value = []byte("peer value")
+			return nil
+		}), true
+	}))
+	if store.Len() != 0 || gee.mainCache.Len() != 0 {
+		t.Fatalf("keys of other peers kept: %v on disk, %v in memory", store.Keys(), gee.mainCache.Keys())
+	}
+}
+
+func TestCompression(t *testing.T) {
+	blob := strings.Repeat(`{"name":"Tom","score":630},`, 100)
+	gee := NewGroup("compress", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		return []byte(blob), nil
+	}), WithCompression(compress.LZ4))
+
+	if view, err := gee.Get("Tom"); err != nil || view.String() != blob {
+		t.Fatalf("Get(Tom) = %q, %v", view.String(), err)
+	}
+	if v, _ := gee.mainCache.Get("Tom"); v.Len() >= len(blob) {
+		t.Fatalf("value was stored uncompressed: %d bytes", v.Len())
+	}
+	if r := gee.Stats.CompressionRatio(); r <= 1 {
+		t.Fatalf("expected a compression ratio above 1, got %v", r)
+	}
+
+	pool := NewHTTPPool("http://localhost:8001")
+	for _, accept := range []string{"", "gzip,lz4"} {
+		req := httptest.NewRequest(http.MethodGet, defaultBasePath+"compress/Tom", nil)
+		if accept != "" {
+			req.Header.Set(acceptCodecHeader, accept)
+		}
+		w := httptest.NewRecorder()
+		pool.ServeHTTP(w, req)
+
+		res := &pb.Response{}
+		if err := proto.Unmarshal(w.Body.Bytes(), res); err != nil {
+			t.Fatal(err)
+		}
+		c, _ := compress.Lookup(res.Codec)
+		if accept != "" && c != compress.LZ4 || accept == "" && c != compress.None {
+			t.Fatalf("accepting %q got codec %q", accept, res.Codec)
+		}
+		if raw, err := c.Decode(res.Value); err != nil || string(raw) != blob {
+			t.Fatalf("accepting %q got a bad value: %v", accept, err)
+		}
+	}
+}
+
+func TestCompressionTranscode(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get(acceptCodecHeader), "gzip") {
+			t.Errorf("client does not accept gzip: %q", r.Header.Get(acceptCodecHeader))
+		}
+		value, _ := compress.Gzip.Encode([]byte("630"))
+		body, _ := proto.Marshal(&pb.Response{Value: value, Codec: "gzip"})
+		w.Write(body)
+	}))
+	defer remote.Close()
+
+	var loads int64
+	gee := NewGroup("transcode", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		atomic.AddInt64(&loads, 1)
+		return nil, fmt.Errorf("%s should come from the peer", key)
+	}), WithCompression(compress.Flate))
+	pool := NewHTTPPool("http://localhost:8001")
+	pool.Set(remote.URL)
+	gee.RegisterPeers(pool)
+
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "630" {
+		t.Fatalf("Get(Tom) = %q, %v", view.String(), err)
+	}
+	if loads != 0 {
+		t.Fatalf("expected the value to come from the peer, got %d loads", loads)
+	}
+}
+
+// testCA is a self-signed certificate authority generated in memory.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "geecache test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue writes a certificate for 127.0.0.1 signed by ca, usable by both
+// servers and clients, to certFile and keyFile.
+func (ca *testCA) issue(t *testing.T, serial int64, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "geecache peer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "peer.crt"), filepath.Join(dir, "peer.key")
+	ca.issue(t, 2, certFile, keyFile)
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server := NewHTTPPool("https://"+l.Addr().String(), WithServerTLS(certs.ServerConfig(ca.pool)))
+	go server.Serve(l)
+
+	var loads int64
+	gee := newTestGroup("tls", &loads)
+	client := NewHTTPPool("https://127.0.0.1:1", WithClientTLS(certs.ClientConfig(ca.pool)))
+	client.Set(server.self)
+	gee.RegisterPeers(client)
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "630" {
+		t.Fatalf("Get(Tom) over mTLS = %q, %v", view.String(), err)
+	}
+	if server.Stats.PeerRequests.Get() != 1 {
+		t.Fatalf("expected the request to reach the TLS peer")
+	}
+
+	// A peer without a client certificate is turned away.
+	anonymous := NewHTTPPool("https://127.0.0.1:1", WithClientTLS(&tls.Config{RootCAs: ca.pool}))
+	g := anonymous.newGetter(server.self)
+	if err := g.Get(&pb.Request{Group: "tls", Key: "Tom"}, &pb.Response{}); err == nil {
+		t.Fatal("request without a client certificate should fail")
+	}
+
+	// Replacing the files rotates the certificate without a restart.
+	ca.issue(t, 3, certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	conn, err := tls.Dial("tcp", l.Addr().String(), certs.ClientConfig(ca.pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber; serial.Int64() != 3 {
+		t.Fatalf("server still presents certificate %v after rotation", serial)
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	var loads int64
+	newTestGroup("signed", &loads)
+	old, next := SigningKey{"k1", []byte("old secret")}, SigningKey{"k2", []byte("new secret")}
+	server := NewHTTPPool("http://localhost:8001", WithSigning(old))
+	client := NewHTTPPool("http://localhost:8002", WithSigning(old))
+
+	serve := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, req)
+		return w.Code
+	}
+	signed := func(p *HTTPPool) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, defaultBasePath+"signed/Tom", nil)
+		if err := p.signRequest(req, nil); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	if code := serve(httptest.NewRequest(http.MethodGet, defaultBasePath+"signed/Tom", nil)); code != http.StatusUnauthorized {
+		t.Fatalf("unsigned request got %d", code)
+	}
+	req := signed(client)
+	if code := serve(req); code != http.StatusOK {
+		t.Fatalf("signed request got %d", code)
+	}
+	if code := serve(req); code != http.StatusUnauthorized {
+		t.Fatalf("replayed request got %d", code)
+	}
+	tampered := signed(client)
+	tampered.URL.Path = defaultBasePath + "signed/Jack"
+	if code := serve(tampered); code != http.StatusUnauthorized {
+		t.Fatalf("tampered request got %d", code)
+	}
+
+	// Rotation: the server accepts both keys while clients move to the new one.
+	server.SetSigningKeys(next, old)
+	if code := serve(signed(client)); code != http.StatusOK {
+		t.Fatalf("request signed with the old key got %d during rotation", code)
+	}
+	client.SetSigningKeys(next)
+	if code := serve(signed(client)); code != http.StatusOK {
+		t.Fatalf("request signed with the new key got %d", code)
+	}
+	server.SetSigningKeys(next)
+	if code := serve(signed(NewHTTPPool("http://localhost:8003", WithSigning(old)))); code != http.StatusUnauthorized {
+		t.Fatalf("request signed with a retired key got %d", code)
+	}
+}
+
+func TestBinaryKeys(t *testing.T) {
+	var loads int64
+	gee := NewGroup("binary/keys", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		atomic.AddInt64(&loads, 1)
+		return []byte(key), nil
+	}))
+	server := NewHTTPPool("http://localhost:8001")
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	client := NewHTTPPool("http://localhost:8002")
+	client.Set(srv.URL)
+	gee.RegisterPeers(client)
+
+	keys := []string{"a/b", "a+b", "100%", "with space", "?x=1#y", "\xff\x00binary"}
+	for _, key := range keys {
+		if view, err := gee.Get(key); err != nil || view.String() != key {
+			t.Fatalf("Get(%q) = %q, %v", key, view.String(), err)
+		}
+	}
+	if n := server.Stats.PeerRequests.Get(); n != int64(len(keys)) {
+		t.Fatalf("expected %d peer requests, got %d", len(keys), n)
+	}
+
+	// Older peers still use the GET form with query-escaped group and key.
+	for _, key := range keys {
+		res, err := http.Get(srv.URL + defaultBasePath + url.QueryEscape("binary/keys") + "/" + url.QueryEscape(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		out := &pb.Response{}
+		if err := proto.Unmarshal(body, out); err != nil || string(out.Value) != key {
+			t.Fatalf("legacy GET of %q = %q, %v (%s)", key, out.Value, err, res.Status)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+defaultBasePath+getPath, nil)
+	req.Header.Set(protocolHeader, "3")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown protocol version got %s", res.Status)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	big := strings.Repeat("0123456789abcdef", 200<<10) // 3.2MB
+	gee := NewGroup("stream", 8<<20, ReaderGetterFunc(func(key string) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(big)), nil
+	}))
+	server := NewHTTPPool("http://localhost:8001", WithStreamThreshold(64<<10))
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	body, _ := proto.Marshal(&pb.Request{Group: "stream", Key: "big"})
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+defaultBasePath+getPath, bytes.NewReader(body))
+	req.Header.Set(protocolHeader, protocolVersion)
+	req.Header.Set(acceptStreamHeader, "1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != streamContentType {
+		t.Fatalf("large value was not streamed, got %q", ct)
+	}
+
+	client := NewHTTPPool("http://localhost:8002")
+	client.Set(srv.URL)
+	gee.RegisterPeers(client)
+	if view, err := gee.Get("big"); err != nil || view.String() != big {
+		t.Fatalf("streamed Get returned %d bytes, %v", view.Len(), err)
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	gee := NewGroup("max-size", 8<<20, GetterFunc(func(key string) ([]byte, error) {
+		return bytes.Repeat([]byte("x"), 4096), nil
+	}), WithMaxValueSize(1024))
+	var tooLarge *ValueTooLargeError
+	if _, err := gee.Get("Tom"); !errors.As(err, &tooLarge) || tooLarge.Limit != 1024 {
+		t.Fatalf("expected a ValueTooLargeError, got %v", err)
+	}
+
+	// Sinks are not filled with values that are too large.
+	sinkGee := NewGroup("max-size-sink", 8<<20, SinkGetterFunc(func(ctx context.Context, key string, dest Sink) error {
+		dest.SetString(strings.Repeat("x", 4096)) // ignores the error on purpose
+		return nil
+	}), WithMaxValueSize(1024))
+	var s string
+	if err := sinkGee.GetInto(context.Background(), "Tom", StringSink(&s)); !errors.As(err, &tooLarge) || s != "" {
+		t.Fatalf("expected a ValueTooLargeError and an empty sink, got %d bytes, %v", len(s), err)
+	}
+
+	// The server enforces the limit the client sends, even for groups without one.
+	NewGroup("max-size-peer", 8<<20, GetterFunc(func(key string) ([]byte, error) {
+		return bytes.Repeat([]byte("x"), 4096), nil
+	}))
+	srv := httptest.NewServer(NewHTTPPool("http://localhost:8001"))
+	defer srv.Close()
+	g := &httpGetter{baseURL: srv.URL + defaultBasePath}
+	err := g.Get(&pb.Request{Group: "max-size-peer", Key: "Tom", MaxValueSize: 100}, &pb.Response{})
+	if !errors.As(err, &tooLarge) || tooLarge.Limit != 100 || tooLarge.Key != "Tom" {
+		t.Fatalf("expected a ValueTooLargeError from the server, got %v", err)
+	}
+
+	// And the client enforces it against servers that don't.
+	careless := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeStream(w, bytes.Repeat([]byte("x"), 4096), "")
+	}))
+	defer careless.Close()
+	g = &httpGetter{baseURL: careless.URL + defaultBasePath}
+	err = g.Get(&pb.Request{Group: "max-size-peer", Key: "Tom", MaxValueSize: 100}, &pb.Response{})
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected a ValueTooLargeError from the client, got %v", err)
+	}
+
+	// The limit applies to decoded values: 4KB of gzip compressed x's is
+	// too large for 1KB although it is sent in far fewer bytes.
+	NewGroup("max-size-gzip", 8<<20, GetterFunc(func(key string) ([]byte, error) {
+		return bytes.Repeat([]byte("x"), 4096), nil
+	}), WithCompression(compress.Gzip))
+	g = &httpGetter{baseURL: srv.URL + defaultBasePath}
+	err = g.Get(&pb.Request{Group: "max-size-gzip", Key: "Tom", MaxValueSize: 1024}, &pb.Response{})
+	if !errors.As(err, &tooLarge) || tooLarge.Limit != 1024 {
+		t.Fatalf("expected a ValueTooLargeError for the decoded size, got %v", err)
+	}
+
+	// A peer sending a small compressed value that decodes to a huge one
+	// is stopped at the limit.
+	bomb, _ := compress.Gzip.Encode(make([]byte, 64<<20))
+	if _, err := gee.transcode("Tom", bomb, compress.Gzip.Name()); !errors.As(err, &tooLarge) || tooLarge.Limit != 1024 {
+		t.Fatalf("expected transcode to stop at the limit, got %v", err)
+	}
+}
+
+func TestSinks(t *testing.T) {
+	var loads int64
+	gee := NewGroup("sinks", 2<<10, SinkGetterFunc(func(ctx context.Context, key string, dest Sink) error {
+		atomic.AddInt64(&loads, 1)
+		if key == "proto" {
+			return dest.SetProto(&pb.Response{Value: []byte("630"), Codec: "none"})
+		}
+		return dest.SetString(db[key])
+	}), WithCompression(compress.Flate))
+
+	// The first Get is filled by the getter itself, the second one from the cache.
+	for i := 0; i < 2; i++ {
+		var s string
+		if err := gee.GetInto(context.Background(), "Tom", StringSink(&s)); err != nil || s != "630" {
+			t.Fatalf("StringSink got %q, %v", s, err)
+		}
+		var b []byte
+		if err := gee.GetInto(context.Background(), "Jack", AllocatingByteSliceSink(&b)); err != nil || string(b) != "589" {
+			t.Fatalf("AllocatingByteSliceSink got %q, %v", b, err)
+		}
+		b[0] = 'X' // the slice belongs to the caller
+		res := &pb.Response{}
+		if err := gee.GetInto(context.Background(), "proto", ProtoSink(res)); err != nil || string(res.Value) != "630" || res.Codec != "none" {
+			t.Fatalf("ProtoSink got %v, %v", res, err)
+		}
+	}
+	if loads != 3 {
+		t.Fatalf("expected 3 loads, got %d", loads)
+	}
+	if view, err := gee.Get("Jack"); err != nil || view.String() != "589" {
+		t.Fatalf("Get(Jack) = %q, %v", view.String(), err)
+	}
+
+	trunc := make([]byte, 2)
+	if err := gee.GetInto(context.Background(), "Sam", TruncatingByteSliceSink(&trunc)); err != nil || string(trunc) != "56" {
+		t.Fatalf("TruncatingByteSliceSink got %q, %v", trunc, err)
+	}
+}
+
+type score struct {
+	Name  string
+	Score int
+}
+
+// countingCodec counts the values it decodes.
+type countingCodec[T any] struct {
+	Codec[T]
+	decodes *int64
+}
+
+func (c countingCodec[T]) Unmarshal(data []byte) (T, error) {
+	atomic.AddInt64(c.decodes, 1)
+	return c.Codec.Unmarshal(data)
+}
+
+func TestTypedGroup(t *testing.T) {
+	loader := TypedGetterFunc[score](func(ctx context.Context, key string) (score, error) {
+		v, ok := db[key]
+		if !ok {
+			return score{}, fmt.Errorf("%s not exist", key)
+		}
+		n, _ := strconv.Atoi(v)
+		return score{key, n}, nil
+	})
+
+	for name, codec := range map[string]Codec[score]{"json": JSONCodec[score]{}, "gob": GobCodec[score]{}} {
+		var decodes int64
+		scores := NewTypedGroup("typed-"+name, 2<<10, countingCodec[score]{codec, &decodes}, loader)
+		for i := 0; i < 3; i++ {
+			if v, err := scores.Get(context.Background(), "Tom"); err != nil || v != (score{"Tom", 630}) {
+				t.Fatalf("%s: Get(Tom) = %+v, %v", name, v, err)
+			}
+		}
+		if decodes != 3 {
+			t.Fatalf("%s: expected every Get to decode, got %d decodes", name, decodes)
+		}
+		if _, err := scores.Get(context.Background(), "unknown"); err == nil {
+			t.Fatalf("%s: expected an error for an unknown key", name)
+		}
+	}
+
+	// With a decoded cache, neither loading nor hitting the cache decodes.
+	var decodes int64
+	scores := NewTypedGroup("typed-decoded", 2<<10, countingCodec[score]{JSONCodec[score]{}, &decodes}, loader,
+		WithDecodedCache(1<<10), WithMaxValueSize(1<<10))
+	if scores.Group().maxValueSize != 1<<10 {
+		t.Fatal("group options passed with the decoded cache were not applied")
+	}
+	for i := 0; i < 3; i++ {
+		if v, err := scores.Get(context.Background(), "Jack"); err != nil || v != (score{"Jack", 589}) {
+			t.Fatalf("Get(Jack) = %+v, %v", v, err)
+		}
+	}
+	if decodes != 0 {
+		t.Fatalf("expected cached decoded values, got %d decodes", decodes)
+	}
+	if view, err := scores.Group().Get("Jack"); err != nil || view.String() != `{"Name":"Jack","Score":589}` {
+		t.Fatalf("underlying Group.Get(Jack) = %q, %v", view.String(), err)
+	}
+
+	requests := NewTypedGroup("typed-proto", 2<<10, ProtoCodec[*pb.Request]{},
+		TypedGetterFunc[*pb.Request](func(ctx context.Context, key string) (*pb.Request, error) {
+			return &pb.Request{Group: "typed-proto", Key: key}, nil
+		}))
+	if v, err := requests.Get(context.Background(), "Sam"); err != nil || v.GetKey() != "Sam" {
+		t.Fatalf("Get(Sam) = %v, %v", v, err)
+	}
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	if strconv.IntSize != 64 {
+		t.Skip("entry overhead is calibrated for 64-bit platforms")
+	}
+	const n = 50000
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%015d", i)
+	}
+	heap := func() uint64 {
+		runtime.GC()
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+
+	c := &Cache{entryOverhead: entryOverhead}
+	before := heap()
+	for _, key := range keys {
+		c.add(key, ByteView{b: make([]byte, 32)})
+	}
+	used := float64(heap() - before)
+	runtime.KeepAlive(c)
+
+	// The keys were allocated before measuring, so leave their bytes out
+	// of the accounted size too.
+	accounted := float64(c.Bytes() - n*int64(len(keys[0])))
+	if r := accounted / used; r < 0.8 || r > 1.25 {
+		t.Fatalf("cache accounts for %.0f bytes, heap grew by %.0f", accounted, used)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	gee := NewGroup("memory-limit", 0, GetterFunc(func(key string) ([]byte, error) {
+		return make([]byte, 100), nil
+	}), WithMemoryLimit(64<<10))
+
+	for i := 0; i < 1000; i++ {
+		gee.Get(strconv.Itoa(i))
+	}
+	if b := gee.mainCache.Bytes(); b > 56<<10 {
+		t.Fatalf("mainCache holds %d bytes, more than its share of the limit", b)
+	}
+	if b := gee.mainCache.Bytes(); b < int64(gee.mainCache.store.len())*(entryOverhead+100) {
+		t.Fatalf("mainCache does not count the entry overhead: %d bytes for %d entries", b, gee.mainCache.store.len())
+	}
+
+	// The test binary's heap is far above 64KB, so the next check evicts.
+	runtime.GC()
+	time.Sleep(memoryCheckInterval)
+	gee.Get("one more")
+	if gee.Stats.MemoryEvictions.Get() == 0 {
+		t.Fatal("expected evictions while the heap is above the limit")
+	}
+}
+
+func TestSizeController(t *testing.T) {
+	getter := GetterFunc(func(key string) ([]byte, error) { return make([]byte, 100), nil })
+	adaptive := NewGroup("adaptive", 64<<10, getter, WithAdaptiveSize(4<<10, 128<<10))
+	fixed := NewGroup("fixed", 64<<10, getter)
+	for i := 0; i < 500; i++ {
+		adaptive.Get(strconv.Itoa(i))
+	}
+
+	var used int64
+	c := NewSizeController(1<<20, time.Hour)
+	c.memoryUsed = func() int64 { return used }
+
+	// Under pressure the budget shrinks down to the floor, evicting entries.
+	used = 950 << 10
+	c.Adjust()
+	if b := adaptive.CacheBytes(); b >= 64<<10 || b < 4<<10 {
+		t.Fatalf("expected the budget to shrink, got %d", b)
+	}
+	if adaptive.mainCache.Bytes() > adaptive.mainCache.size() {
+		t.Fatalf("mainCache holds %d bytes over its %d budget", adaptive.mainCache.Bytes(), adaptive.mainCache.size())
+	}
+	for i := 0; i < 20; i++ {
+		c.Adjust()
+	}
+	if b := adaptive.CacheBytes(); b != 4<<10 {
+		t.Fatalf("expected the budget to stop at the floor, got %d", b)
+	}
+
+	// In the comfortable zone nothing changes.
+	used = 800 << 10
+	c.Adjust()
+	if b := adaptive.CacheBytes(); b != 4<<10 {
+		t.Fatalf("expected the budget to stay put, got %d", b)
+	}
+
+	// Without pressure it grows back up to the ceiling.
+	used = 100 << 10
+	for i := 0; i < 100; i++ {
+		c.Adjust()
+	}
+	if b := adaptive.CacheBytes(); b != 128<<10 {
+		t.Fatalf("expected the budget to grow to the ceiling, got %d", b)
+	}
+	if b := fixed.CacheBytes(); b != 64<<10+8<<10 {
+		t.Fatalf("a group without WithAdaptiveSize was resized to %d", b)
+	}
+
+	// The starting budget doesn't depend on the order of the options.
+	before := NewGroup("adaptive-before", 64<<10, getter, WithAdaptiveSize(16<<10, 32<<10), WithMemoryLimit(8<<10))
+	after := NewGroup("adaptive-after", 64<<10, getter, WithMemoryLimit(8<<10), WithAdaptiveSize(16<<10, 32<<10))
+	if b, a := before.CacheBytes(), after.CacheBytes(); b != 16<<10 || a != 16<<10 {
+		t.Fatalf("starting budgets are %d and %d, want the floor %d", b, a, 16<<10)
+	}
+}
+
+func TestArenaStorage(t *testing.T) {
+	store, err := disk.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var loads int64
+	gee := NewGroup("arena", 1<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte(strings.Repeat("v", 50) + key), nil
+		}), WithArenaStorage(), WithDiskTier(store))
+
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		if v, err := gee.Get(key); err != nil || v.String() != strings.Repeat("v", 50)+key {
+			t.Fatalf("Get(%s) = %q, %v", key, v.String(), err)
+		}
+	}
+	if b := gee.mainCache.Bytes(); b > 1<<10 {
+		t.Fatalf("arena holds %d bytes, more than cacheBytes", b)
+	}
+	if store.Len() == 0 {
+		t.Fatalf("entries evicted from the arena were not spilled to disk")
+	}
+	for i := 0; i < 100; i++ {
+		gee.Get(strconv.Itoa(i))
+	}
+	if loads != 100 {
+		t.Fatalf("expect 100 loads, but %d got", loads)
+	}
+}
+
+func TestEvictionListener(t *testing.T) {
+	store, err := disk.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var evictions []string
+	var gee *Group
+	gee = NewGroup("eviction-listener", 50, GetterFunc(
+		func(key string) ([]byte, error) {
+			if v, ok := db[key]; ok {
+				return []byte(v), nil
+			}
+			return nil, fmt.Errorf("%s not exist", key)
+		}), WithDiskTier(store), WithCompression(compress.Gzip),
+		WithEvictionListener(func(key string, value ByteView, reason EvictionReason) {
+			evictions = append(evictions, key+"="+value.String()+" "+reason.String())
+			gee.mainCache.Len() // must not deadlock
+		}))
+
+	gee.Get("Tom")
+	gee.Get("Jack") // both gzipped entries do not fit, Tom goes
+	if expect := []string{"Tom=630 capacity"}; !reflect.DeepEqual(evictions, expect) {
+		t.Fatalf("expect evictions %v, but %v got", expect, evictions)
+	}
+
+	// Jack now belongs to another peer: it is deleted, not spilled.
+	gee.RegisterPeers(remotePicker{"Jack": true})
+	if expect := []string{"Tom=630 capacity", "Jack=589 deleted"}; !reflect.DeepEqual(evictions, expect) {
+		t.Fatalf("expect evictions %v, but %v got", expect, evictions)
+	}
+	if _, err := store.Get("Jack"); err != disk.ErrNotFound {
+		t.Fatalf("deleted entry was spilled to disk: %v", err)
+	}
+}
+
+// recordingObserver records the events it sees as strings.
+type recordingObserver struct {
+	NopObserver
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, args ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) Hit(group, key string)  { o.record("hit %s", key) }
+func (o *recordingObserver) Miss(group, key string) { o.record("miss %s", key) }
+func (o *recordingObserver) PeerLoad(group, key, peer string, latency time.Duration) {
+	o.record("peer %s from %s", key, peer)
+}
+func (o *recordingObserver) PeerError(group, key, peer string, err error) {
+	o.record("peer error %s from %s", key, peer)
+}
+func (o *recordingObserver) LocalLoad(group, key string, latency time.Duration) {
+	o.record("local %s", key)
+}
+func (o *recordingObserver) LoadError(group, key string, err error) { o.record("error %s", key) }
+func (o *recordingObserver) Dedup(group, key string)                { o.record("dedup %s", key) }
+func (o *recordingObserver) Evict(group, key string, reason EvictionReason) {
+	o.record("evict %s %s", key, reason)
+}
+
+type peerFunc func(in *pb.Request, out *pb.Response) error
+
+func (f peerFunc) Get(in *pb.Request, out *pb.Response) error { return f(in, out) }
+func (f peerFunc) String() string                             { return "fake" }
+
+type funcPicker func(key string) (PeerGetter, bool)
+
+func (f funcPicker) PickPeer(key string) (PeerGetter, bool) { return f(key) }
+
+func TestObservers(t *testing.T) {
+	release := make(chan struct{})
+	o1, o2 := &recordingObserver{}, &recordingObserver{}
+	gee := NewGroup("observers", 8, GetterFunc(
+		func(key string) ([]byte, error) {
+			if key == "slow" {
+				<-release
+			}
+			if v, ok := db[key]; ok || key == "slow" {
+				return []byte(v), nil
+			}
+			return nil, fmt.Errorf("%s not exist", key)
+		}), WithObserver(o1), WithObserver(o2))
+	gee.RegisterPeers(funcPicker(func(key string) (PeerGetter, bool) {
+		if key != "remote" {
+			return nil, false
+		}
+		return peerFunc(func(in *pb.Request, out *pb.Response) error {
+			out.Value = []byte("peer value")
+			return nil
+		}), true
+	}))
+
+	gee.Get("Tom")
+	gee.Get("Tom")
+	gee.Get("unknown")
+	gee.Get("remote")
+	gee.Get("Jack") // evicts Tom
+
+	expect := []string{
+		"miss Tom", "local Tom", "hit Tom",
+		"miss unknown", "error unknown",
+		"miss remote", "peer remote from fake",
+		"miss Jack", "evict Tom capacity", "local Jack",
+	}
+	if !reflect.DeepEqual(o1.events, expect) || !reflect.DeepEqual(o2.events, expect) {
+		t.Fatalf("expect events\n%q\nbut got\n%q\nand\n%q", expect, o1.events, o2.events)
+	}
+
+	o1.events = nil
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gee.Get("slow")
+		}()
+	}
+	for {
+		o1.mu.Lock()
+		n := len(o1.events)
+		o1.mu.Unlock()
+		if n == 2 { // both missed, one of them is loading
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // let the second Get reach the loader
+	close(release)
+	wg.Wait()
+	if !strings.Contains(strings.Join(o1.events, ","), "dedup slow") {
+		t.Fatalf("concurrent Gets were not reported as deduplicated: %q", o1.events)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	var loads int64
+	gee := NewGroup("logging", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			loads++
+			return []byte("secret value"), nil
+		}), WithLogger(logger))
+
+	gee.Get("alice@example.com")
+	gee.Get("alice@example.com")
+	out := buf.String()
+	for _, want := range []string{"msg=miss", "msg=loaded", "msg=hit", "group=logging", "key_hash=" + keyHash("alice@example.com"), "latency="} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "alice") {
+		t.Errorf("log contains the raw key:\n%s", out)
+	}
+
+	// Groups log nothing by default.
+	quiet := newTestGroup("logging-quiet", &loads)
+	if quiet.logger.Enabled(context.Background(), slog.LevelError) {
+		t.Error("default logger is enabled")
+	}
+}
+
+func TestSamplingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewSamplingHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}), slog.LevelInfo, 3)
+	logger := slog.New(h).With("pool", "p")
+	for i := 0; i < 6; i++ {
+		logger.Debug("hit")
+	}
+	logger.Warn("peer get failed")
+
+	if n := strings.Count(buf.String(), "msg=hit"); n != 2 {
+		t.Fatalf("expect 2 of 6 debug records, but %d got", n)
+	}
+	if !strings.Contains(buf.String(), "msg=\"peer get failed\"") {
+		t.Fatalf("warn record was sampled away")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	spans := &tracing.InMemoryExporter{}
+	tracer := tracing.NewTracer(spans)
+	var loads int64
+	gee := NewGroup("tracing", 2<<10, GetterFunc(
+		func(key string) ([]byte, error) {
+			atomic.AddInt64(&loads, 1)
+			return []byte(db[key]), nil
+		}), WithTracer(tracer))
+
+	hb := &handlerFunc{}
+	b := httptest.NewServer(hb)
+	defer b.Close()
+	poolA, poolB := NewHTTPPool("http://a.invalid"), NewHTTPPool(b.URL, WithPoolTracer(tracer))
+	poolA.Set(b.URL)
+	hb.h = poolB
+	gee.RegisterPeers(poolA)
+
+	if _, err := gee.Get("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	// Both nodes are in this process, so the spans of node b are here too.
+	// Every span is expected once, under the parent named by its key.
+	exported := spans.Spans()
+	byID := make(map[tracing.SpanID]tracing.SpanData)
+	for _, s := range exported {
+		byID[s.Context.SpanID] = s
+	}
+	got := make(map[string]tracing.SpanData)
+	for _, s := range exported {
+		key := s.Name + " < " + byID[s.ParentID].Name
+		if _, ok := got[key]; ok {
+			t.Fatalf("span %s exported twice", key)
+		}
+		got[key] = s
+	}
+	root := got["geecache.Get < "]
+	for _, key := range []string{
+		"geecache.load < geecache.Get",
+		"geecache.getFromPeer < geecache.load",
+		"geecache.ServeHTTP < geecache.getFromPeer",
+		"geecache.load < geecache.ServeHTTP",
+		"geecache.getLocally < geecache.load",
+	} {
+		s, ok := got[key]
+		if !ok {
+			t.Fatalf("no span %s in %v", key, exported)
+		}
+		if s.Context.TraceID != root.Context.TraceID {
+			t.Errorf("%s is in trace %s, expect %s", key, s.Context.TraceID, root.Context.TraceID)
+		}
+	}
+	if len(exported) != 6 {
+		t.Errorf("expect 6 spans, but %d got", len(exported))
+	}
+	if s := got["geecache.ServeHTTP < geecache.getFromPeer"]; !s.Remote || s.Attrs["group"] != "tracing" || s.Attrs["key_hash"] != keyHash("Tom") {
+		t.Errorf("ServeHTTP span = %+v", s)
+	}
+	if s := got["geecache.getFromPeer < geecache.load"]; s.Attrs["peer"] != b.URL+defaultBasePath || s.Err != nil {
+		t.Errorf("getFromPeer span = %+v", s)
+	}
+
+	// A hit is a single span.
+	spans.Reset()
+	gee.Get("Tom")
+	if s := spans.Spans(); len(s) != 1 || s[0].Name != "geecache.Get" {
+		t.Fatalf("cache hit exported %v", s)
+	}
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	serve := func(p *HTTPPool, path string, body io.Reader) int {
+		req := httptest.NewRequest(http.MethodPost, defaultBasePath+path, body)
+		req.ContentLength = -1 // chunked, the size is only known once read
+		req.Header.Set(protocolHeader, protocolVersion)
+		req.Header.Set(fromPeerHeader, "http://192.0.2.1:8002") // where httptest requests come from
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		return w.Code
+	}
+	huge := func() *countingReader {
+		return &countingReader{r: io.LimitReader(zeroReader{}, maxTransferSize+1)}
+	}
+
+	pool := NewHTTPPool("http://localhost:8001")
+	pool.Set("http://localhost:8001", "http://192.0.2.1:8002")
+	for _, path := range []string{getPath, transferPath} {
+		if code := serve(pool, path, huge()); code != http.StatusRequestEntityTooLarge {
+			t.Errorf("huge %s request got %d", path, code)
+		}
+	}
+	req := httptest.NewRequest(http.MethodPost, defaultBasePath+getPath, strings.NewReader("x"))
+	req.ContentLength = maxRequestSize + 1
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("request announcing a huge body got %d", w.Code)
+	}
+
+	// Without a well-formed signature the body is not read at all.
+	signed := NewHTTPPool("http://localhost:8001", WithSigning(SigningKey{"k1", []byte("secret")}))
+	body := huge()
+	if code := serve(signed, getPath, body); code != http.StatusUnauthorized || body.n != 0 {
+		t.Errorf("unsigned request got %d after reading %d bytes", code, body.n)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestPoolLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	pool := NewHTTPPool("http://localhost:8001", WithPoolLogger(logger))
+	pool.Log("peers changed", "peers", 3, slog.String("source", "file"))
+	for _, want := range []string{`msg="peers changed"`, "peers=3", "source=file", "self=http://localhost:8001"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log lacks %q: %s", want, buf.String())
+		}
+	}
+}
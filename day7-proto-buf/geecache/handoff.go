@@ -0,0 +1,216 @@
+package geecache
+
+// 节点加入或离开时，hash环上一部分key会换主人。新主人的缓存是空的，这些key会集中打到slow DB上。
+// handoff让旧主人把自己还缓存着的这部分key分批、限速地推给新主人，实现“热迁移”。
+
+import (
+	"context"
+	pb "geecache/geecachepb"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	transferPath = "_transfer"
+
+	defaultHandoffBatch = 100
+	defaultHandoffRate  = 1000
+)
+
+// HandoffOptions control how cached keys are handed to their new owner.
+type HandoffOptions struct {
+	BatchSize int // entries per Transfer request, defaults to 100
+	Rate      int // entries per second, defaults to 1000
+}
+
+// WithHandoff makes the pool stream the keys it no longer owns, and still
+// holds in mainCache, to their new owner whenever Set changes the ring.
+func WithHandoff(opts HandoffOptions) PoolOption {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultHandoffBatch
+	}
+	if opts.Rate <= 0 {
+		opts.Rate = defaultHandoffRate
+	}
+	return func(p *HTTPPool) {
+		h := &handoff{pool: p, opts: opts}
+		p.hooks = append(p.hooks, h.start)
+	}
+}
+
+type handoff struct {
+	pool *HTTPPool
+	opts HandoffOptions
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // cancels the handoff started by the previous change
+}
+
+func (h *handoff) start(c OwnershipChange) {
+	if c.Prev == nil {
+		return
+	}
+
+	h.mu.Lock()
+	if h.cancel != nil {
+		h.cancel() // 环又变了，上一次的迁移计划已经过时
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.mu.Unlock()
+
+	go h.run(ctx, c)
+}
+
+func (h *handoff) run(ctx context.Context, c OwnershipChange) {
+	for _, g := range groupsUsing(h.pool) {
+		moved := make(map[string][]string) // new owner -> keys
+		for _, key := range g.mainCache.Keys() {
+			// 只有不再拥有这个key的节点才负责推送，推给新加入的每个owner。
+			if from, to, ok := c.Moved(key); ok && slices.Contains(from, c.Self) {
+				for _, owner := range to {
+					moved[owner] = append(moved[owner], key)
+				}
+			}
+		}
+		for owner, keys := range moved {
+			if err := h.send(ctx, g, owner, keys); err != nil {
+				h.pool.logger.Warn("handoff failed", "group", g.name, "peer", owner, "keys", len(keys), "error", err)
+			}
+		}
+	}
+}
+
+// send transfers keys to owner in batches, waiting between batches so
+// that no more than opts.Rate entries are sent per second.
+func (h *handoff) send(ctx context.Context, g *Group, owner string, keys []string) error {
+	peer := h.pool.getter(owner)
+	if peer == nil {
+		return nil // owner already left the ring again
+	}
+
+	// Rate比BatchSize大十亿倍以上时间隔会被截成0，NewTicker(0)会panic。
+	interval := max(time.Second*time.Duration(h.opts.BatchSize)/time.Duration(h.opts.Rate), time.Nanosecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for start := 0; start < len(keys); start += h.opts.BatchSize {
+		if start > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		end := min(start+h.opts.BatchSize, len(keys))
+		req := &pb.TransferRequest{Group: g.name, Codec: g.codec.Name()}
+		for _, key := range keys[start:end] {
+			if v, _, ok := g.mainCache.peek(key); ok {
+				req.Entries = append(req.Entries, &pb.Entry{Key: []byte(key), Value: v.bytes()})
+			}
+		}
+		if len(req.Entries) == 0 {
+			continue
+		}
+
+		res := &pb.TransferResponse{}
+		if err := peer.Transfer(ctx, req, res); err != nil {
+			if ctx.Err() != nil {
+				return nil // 被新的一次环变化取消了，不算失败
+			}
+			return err
+		}
+		h.pool.Stats.HandoffSent.Add(res.GetAccepted())
+	}
+	return nil
+}
+
+// serveTransfer accepts entries handed over by their previous owner. Only
+// keys this node owns according to its own ring are kept.
+func (p *HTTPPool) serveTransfer(w http.ResponseWriter, r *http.Request) {
+	// 开了签名的话ServeHTTP已经验过了；没开签名就只接受环上peer发来的，否则谁都能往缓存里写。
+	if len(p.keys()) == 0 && !p.fromRingPeer(r) {
+		p.logger.Warn("rejected transfer", "remote", r.RemoteAddr, "peer", r.Header.Get(fromPeerHeader))
+		http.Error(w, "transfers are only accepted from peers", http.StatusForbidden)
+		return
+	}
+	body, err := io.ReadAll(r.Body) // 已经被ServeHTTP限制在maxTransferSize以内
+	if err != nil {
+		requestError(w, err, http.StatusBadRequest)
+		return
+	}
+	req := &pb.TransferRequest{}
+	if err := proto.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group := GetGroup(req.GetGroup())
+	if group == nil {
+		http.Error(w, "no such group: "+req.GetGroup(), http.StatusNotFound)
+		return
+	}
+
+	var accepted int64
+	for _, e := range req.GetEntries() {
+		key := string(e.GetKey())
+		if !p.Owns(key) {
+			continue
+		}
+		v, err := group.transcode(key, e.GetValue(), req.GetCodec())
+		if _, ok := err.(*ValueTooLargeError); ok {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		group.populateCache(key, v)
+		accepted++
+	}
+	p.Stats.HandoffReceived.Add(accepted)
+
+	body, err = proto.Marshal(&pb.TransferResponse{Accepted: accepted})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+}
+
+// fromRingPeer reports whether r was sent by another peer in the ring: it
+// must be marked as coming from one, and come from an address of its host.
+// Peers reaching each other through proxies or NAT need WithSigning to
+// hand off keys.
+func (p *HTTPPool) fromRingPeer(r *http.Request) bool {
+	from := r.Header.Get(fromPeerHeader)
+	if from == "" || from == p.self || p.getter(from) == nil {
+		return false
+	}
+	u, err := url.Parse(from)
+	if err != nil {
+		return false
+	}
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remoteIP := net.ParseIP(remote)
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		return ip.Equal(remoteIP)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(r.Context(), u.Hostname())
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(addrs, func(a net.IPAddr) bool { return a.IP.Equal(remoteIP) })
+}
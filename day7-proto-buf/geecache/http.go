@@ -3,16 +3,24 @@ package geecache
 // 提供被其他节点访问的能力
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"geecache/consistenthash"
+	"geecache/discovery"
 	pb "geecache/geecachepb"
+	"geecache/tracing"
 	"io"
 
 	"google.golang.org/protobuf/proto"
 
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -20,6 +28,31 @@ import (
 const (
 	defaultBasePath = "/_geecache/"
 	defaultReplicas = 50
+
+	// fromPeerHeader marks a request as sent by another peer. Its value is
+	// the sender's base URL. A node never forwards such a request again.
+	fromPeerHeader = "X-Geecache-From"
+	// ringHeader carries the sender's consistenthash.Map digest so the two
+	// sides can notice when they disagree about key ownership.
+	ringHeader = "X-Geecache-Ring"
+	// acceptCodecHeader lists the compress.Codec names the client can
+	// decode, comma separated. Values encoded with any other codec are
+	// decoded by the server before they are sent.
+	acceptCodecHeader = "X-Geecache-Accept-Codec"
+
+	// getPath is where peers POST a marshalled pb.Request, marked with
+	// protocolHeader. Version 1 of the protocol was a GET of
+	// basePath/group/key, which is still served for older peers.
+	getPath         = "_get"
+	protocolHeader  = "X-Geecache-Protocol"
+	protocolVersion = "2"
+
+	// maxRequestSize is the largest body accepted with a get request, and
+	// maxTransferSize with a batch of handed over entries. Bodies are read
+	// into memory before the signature can be checked, so a client without
+	// credentials must not be able to make them arbitrarily large.
+	maxRequestSize  = 1 << 20
+	maxTransferSize = 64 << 20
 )
 
 // HTTPPool implements PeerPicker for a pool of HTTP peers.
@@ -28,20 +61,67 @@ type HTTPPool struct {
 	basePath    string                 // 项目名。可能会有多个项目，所以加以区分。
 	mu          sync.Mutex             // guards peers and httpGetters
 	peers       *consistenthash.Map    // hash环，用于记录所有的server。
+	ring        string                 // digest of peers, exchanged with other peers to detect ring disagreement
 	httpGetters map[string]*httpGetter // string is key of cacheserver like e.g. "http://10.0.0.2:8008"。httpgetter非常简单：一个url+一个get方法。
+
+	hooks []func(OwnershipChange) // called after every Set, see OnOwnershipChange
+
+	zone        string            // zone of this node, see WithZone
+	zones       map[string]string // peer -> zone, see SetZones
+	replication int               // number of peers owning each key
+	zoneCopies  bool              // keep local copies of hot keys fetched from other zones
+
+	serverTLS *tls.Config  // see WithServerTLS
+	client    *http.Client // client for other peers, see WithClientTLS
+
+	streamThreshold int // stream values of at least this size, see WithStreamThreshold
+
+	signingKeys []SigningKey // see WithSigning
+	nonces      *nonceCache  // nonces of recently verified requests
+
+	logger *slog.Logger    // see WithPoolLogger
+	tracer *tracing.Tracer // see WithPoolTracer
+
+	// Stats are counters describing the traffic between this pool and its peers.
+	Stats PoolStats
 }
 
+// PoolStats are per-pool statistics.
+type PoolStats struct {
+	PeerRequests    AtomicInt // requests received from other peers
+	RingMismatches  AtomicInt // exchanges where the two sides had different rings
+	HandoffSent     AtomicInt // entries handed to their new owner
+	HandoffReceived AtomicInt // entries accepted from their previous owner
+	SameZonePicks   AtomicInt // keys fetched from a peer in our zone
+	CrossZonePicks  AtomicInt // keys fetched from a peer in another zone
+	CrossZoneBytes  AtomicInt // response bytes received from other zones
+}
+
+// A PoolOption configures an HTTPPool.
+type PoolOption func(*HTTPPool)
+
 // NewHTTPPool initializes an HTTP pool of peers.
-func NewHTTPPool(self string) *HTTPPool {
-	return &HTTPPool{
-		self:     self,
-		basePath: defaultBasePath,
+func NewHTTPPool(self string, opts ...PoolOption) *HTTPPool {
+	p := &HTTPPool{
+		self:            self,
+		basePath:        defaultBasePath,
+		replication:     1,
+		streamThreshold: defaultStreamThreshold,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.logger == nil {
+		p.logger = quietLogger
 	}
+	p.logger = p.logger.With("self", self)
+	return p
 }
 
-// Log info with server name
-func (p *HTTPPool) Log(format string, v ...interface{}) {
-	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
+// Log logs msg at the Info level to the pool's logger, with args as its
+// attributes: key/value pairs or slog.Attrs, as for slog.Logger.Info.
+func (p *HTTPPool) Log(msg string, args ...any) {
+	p.logger.Info(msg, args...)
 }
 
 // ServeHTTP handle all http requests
@@ -49,17 +129,56 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if !strings.HasPrefix(r.URL.Path, p.basePath) { // r.URL.Path: "/_geecache/scores/Tom"
 		panic("HTTPPool serving unexpected path: " + r.URL.Path)
 	}
-	p.Log("%s %s", r.Method, r.URL.Path)
+	ctx, span := p.tracer.Start(tracing.Extract(r.Context(), r.Header), "geecache.ServeHTTP")
+	defer span.End()
+	span.SetAttr("method", r.Method)
+	span.SetAttr("path", r.URL.Path)
 
-	// r.URL.Path: /_geecache/scores/Tom
-	parts := strings.SplitN(r.URL.Path[len(p.basePath):], "/", 2)
-	if len(parts) != 2 { //做了一个简单的判错
-		http.Error(w, "bad request", http.StatusBadRequest)
+	limit := int64(maxRequestSize)
+	if r.URL.Path == p.basePath+transferPath {
+		limit = maxTransferSize
+	}
+	if r.ContentLength > limit {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	if err := p.verifyRequest(r); err != nil {
+		p.logger.Warn("rejected request", "remote", r.RemoteAddr, "error", err)
+		requestError(w, err, http.StatusUnauthorized)
 		return
 	}
 
-	groupName := parts[0]
-	key := parts[1]
+	if r.Method == http.MethodPost && r.URL.Path == p.basePath+transferPath {
+		p.serveTransfer(w, r)
+		return
+	}
+
+	// 被其他peer转发过来的请求只能在本地处理，不能再转发出去，避免请求在节点之间来回弹。
+	from := r.Header.Get(fromPeerHeader)
+	if from != "" {
+		p.Stats.PeerRequests.Add(1)
+		p.checkRing(from, r.Header.Get(ringHeader))
+	}
+	if ring := p.ringDigest(); ring != "" {
+		w.Header().Set(ringHeader, ring)
+	}
+
+	req, err := p.parseRequest(r)
+	if err != nil {
+		requestError(w, err, http.StatusBadRequest)
+		return
+	}
+	groupName, key := req.GetGroup(), requestKey(req)
+	if p.logger.Enabled(r.Context(), slog.LevelDebug) {
+		p.logger.Debug("request", "group", groupName, keyAttr(key), "peer", from)
+	}
+	if span != nil {
+		span.SetAttr("group", groupName)
+		span.SetAttr("key_hash", keyHash(key))
+		span.SetAttr("peer", from)
+	}
 
 	group := GetGroup(groupName)
 	if group == nil {
@@ -67,33 +186,213 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	view, err := group.Get(key)
+	view, _, err := group.get(ctx, key, from != "", nil)
+	span.SetError(err)
+	if e, ok := err.(*ValueTooLargeError); ok {
+		writeTooLarge(w, e)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	value, codec, err := group.wireValue(view, r.Header.Get(acceptCodecHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := group.checkSize(key, value, codec, req.GetMaxValueSize()); err != nil {
+		if e, ok := err.(*ValueTooLargeError); ok {
+			writeTooLarge(w, e)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if p.streamThreshold > 0 && len(value) >= p.streamThreshold && r.Header.Get(acceptStreamHeader) != "" {
+		writeStream(w, value, codec)
+		return
+	}
 
-	body, err := proto.Marshal(&pb.Response{Value: view.ByteSlice()})
+	body, err := proto.Marshal(&pb.Response{Value: value, Codec: codec})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Write(body)
 }
 
+// requestError replies to a request that could not be read with code, or
+// with 413 if its body was too large.
+func requestError(w http.ResponseWriter, err error, code int) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		code = http.StatusRequestEntityTooLarge
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// parseRequest returns the request made by r.
+func (p *HTTPPool) parseRequest(r *http.Request) (*pb.Request, error) {
+	if r.Method == http.MethodPost && r.URL.Path == p.basePath+getPath {
+		if v := r.Header.Get(protocolHeader); v != protocolVersion {
+			return nil, fmt.Errorf("unsupported protocol version %q", v)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		req := &pb.Request{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			return nil, fmt.Errorf("decoding request body: %v", err)
+		}
+		return req, nil
+	}
+
+	// 旧的GET协议：/_geecache/scores/Tom，group和key都用url.QueryEscape转义过。
+	// r.URL.Path已经被解码了，key里的'/'会把group和key切错，所以按转义后的path切分，再分别解码。
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), p.basePath), "/", 2)
+	if len(parts) != 2 { //做了一个简单的判错
+		return nil, errors.New("bad request")
+	}
+	group, err := url.QueryUnescape(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := url.QueryUnescape(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Request{Group: group, BinaryKey: []byte(key)}, nil
+}
+
+// requestKey returns the key asked for by req.
+func requestKey(req *pb.Request) string {
+	if len(req.GetBinaryKey()) > 0 {
+		return string(req.GetBinaryKey())
+	}
+	return req.GetKey()
+}
+
 // Set updates the pool's list of peers.
 // Set不仅将所有的cache server地址注册进了hash环，还将这些地址包进了httpgetter。后面的使用就是：先找hash环，再根据hash环所得
 // key对应的httpgetter的Get方法来实现http请求。
 func (p *HTTPPool) Set(peers ...string) { // peers[0] == "http://localhost:8001"
 	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	p.peers = consistenthash.New(defaultReplicas, nil) // 只会在开始的时候调用一次
+	prev := p.peers
+	p.peers = consistenthash.New(defaultReplicas, nil) // 每次都新建一个hash环，旧的环留给hook比较归属变化
 	p.peers.Add(peers...)
+	p.ring = p.peers.Digest()
 	p.httpGetters = make(map[string]*httpGetter, len(peers)) // httppool的getter和地址是分开实现的。
 	for _, peer := range peers {
-		p.httpGetters[peer] = &httpGetter{baseURL: peer + p.basePath}
+		p.httpGetters[peer] = p.newGetter(peer)
+	}
+	change := OwnershipChange{Self: p.self, Prev: prev, Next: p.peers, Replication: p.replication}
+	hooks := p.hooks
+	p.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(change)
+	}
+}
+
+// An OwnershipChange describes how a call to Set changed the ring.
+// The maps must not be modified.
+type OwnershipChange struct {
+	Self        string
+	Prev        *consistenthash.Map // nil on the first Set
+	Next        *consistenthash.Map
+	Replication int // number of peers owning each key, see WithReplication
+}
+
+// Moved reports whether the owners of key changed: from are the peers
+// that no longer own it, to the peers that newly do.
+func (c OwnershipChange) Moved(key string) (from, to []string, ok bool) {
+	if c.Prev == nil {
+		return nil, nil, false
+	}
+	n := max(c.Replication, 1)
+	prev, next := c.Prev.GetN(key, n), c.Next.GetN(key, n)
+	from, to = without(prev, next), without(next, prev)
+	return from, to, len(from) > 0 || len(to) > 0
+}
+
+// without returns the peers of a that are not in b.
+func without(a, b []string) []string {
+	var d []string
+	for _, peer := range a {
+		if !slices.Contains(b, peer) {
+			d = append(d, peer)
+		}
+	}
+	return d
+}
+
+// OnOwnershipChange registers fn to be called after every Set. Hooks run
+// in the goroutine that called Set and should not block.
+func (p *HTTPPool) OnOwnershipChange(fn func(OwnershipChange)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hooks = append(p.hooks, fn)
+}
+
+// newGetter creates the httpGetter for peer. p.mu must be held.
+func (p *HTTPPool) newGetter(peer string) *httpGetter {
+	return &httpGetter{baseURL: peer + p.basePath, pool: p, crossZone: p.crossZone(peer)}
+}
+
+// getter returns the httpGetter of peer, or nil if peer isn't in the pool.
+func (p *HTTPPool) getter(peer string) *httpGetter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.httpGetters[peer]
+}
+
+// ringDigest returns the digest of the pool's current ring, or "" if Set
+// has not been called yet.
+func (p *HTTPPool) ringDigest() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ring
+}
+
+// checkRing compares a peer's ring digest with ours and reports a mismatch.
+// A mismatch means the two nodes may route the same key to different owners.
+func (p *HTTPPool) checkRing(peer, theirs string) {
+	ours := p.ringDigest()
+	if theirs == "" || ours == "" || theirs == ours {
+		return
+	}
+	p.Stats.RingMismatches.Add(1)
+	p.logger.Warn("ring mismatch", "peer", peer, "ours", ours, "theirs", theirs)
+}
+
+// Watch applies every peer set reported by d with Set until ctx is done.
+// The first peer set is applied before Watch returns.
+func (p *HTTPPool) Watch(ctx context.Context, d discovery.Discovery) error {
+	updates, err := d.Watch(ctx)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case peers, ok := <-updates:
+		if !ok {
+			return ctx.Err()
+		}
+		p.Set(peers...)
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+
+	go func() {
+		for peers := range updates {
+			p.logger.Info("peers updated", "peers", peers)
+			p.Set(peers...)
+		}
+	}()
+	return nil
 }
 
 // PickPeer picks a peer according to key
@@ -101,46 +400,191 @@ func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if peer := p.peers.Get(key); peer != "" && peer != p.self {
-		p.Log("Pick peer %s", peer)
+	if p.peers == nil {
+		return nil, false
+	}
+	if peer := p.pickReplica(p.peers.GetN(key, p.replication)); peer != "" && peer != p.self {
+		if p.logger.Enabled(context.Background(), slog.LevelDebug) {
+			p.logger.Debug("pick peer", keyAttr(key), "peer", peer)
+		}
+		if p.zone != "" && p.zones[peer] != "" {
+			if p.crossZone(peer) {
+				p.Stats.CrossZonePicks.Add(1)
+			} else {
+				p.Stats.SameZonePicks.Add(1)
+			}
+		}
 		return p.httpGetters[peer], true
 	}
 	return nil, false
 }
 
+// Owns reports whether this node is one of the owners of key. Unlike
+// PickPeer it has no side effects, so it can be called for every cached
+// key when the ring changes.
+func (p *HTTPPool) Owns(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peers == nil {
+		return true
+	}
+	owners := p.peers.GetN(key, p.replication)
+	return len(owners) == 0 || slices.Contains(owners, p.self)
+}
+
 var _ PeerPicker = (*HTTPPool)(nil) // 用来检验是否HTTPPool已经实现了接口PeerPicker
 
 // 可以理解为http客户端，用来发出http请求的。
 type httpGetter struct {
-	baseURL string // e.g. "http://localhost:8001/_geecache/"
+	baseURL   string    // e.g. "http://localhost:8001/_geecache/"
+	pool      *HTTPPool // the pool that owns this getter, used to mark requests as coming from a peer
+	crossZone bool      // the peer is in another zone than the pool
+}
+
+// String returns the peer's base URL.
+func (h *httpGetter) String() string {
+	return h.baseURL
 }
 
 func (h *httpGetter) Get(in *pb.Request, out *pb.Response) error {
-	u := fmt.Sprintf(
-		"%v%v/%v",
-		h.baseURL,
-		url.QueryEscape(in.GetGroup()), // 将特殊字符进行转义。
-		url.QueryEscape(in.GetKey()),
-	)
-	res, err := http.Get(u)
+	return h.GetContext(context.Background(), in, out)
+}
+
+// GetContext is Get sending the trace in ctx along with the request.
+func (h *httpGetter) GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error {
+	// key放在body里而不是URL里，任意字节都能原样传过去。
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return err
+	}
+	res, err := h.do(ctx, http.MethodPost, h.baseURL+getPath, body)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
+	limit := in.GetMaxValueSize()
+	tooLarge := func() error {
+		return &ValueTooLargeError{Group: in.GetGroup(), Key: requestKey(in), Limit: limit}
+	}
+	if res.StatusCode == http.StatusRequestEntityTooLarge {
+		limit, _ = strconv.ParseInt(res.Header.Get(maxValueSizeHeader), 10, 64)
+		return tooLarge()
+	}
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("server returned: %v", res.Status)
 	}
 
-	bytes, err := io.ReadAll(res.Body)
+	if res.Header.Get("Content-Type") == streamContentType {
+		size, err := strconv.ParseInt(res.Header.Get(valueSizeHeader), 10, 64)
+		if err != nil {
+			size = -1
+		}
+		streamLimit := limit
+		if res.Header.Get(codecHeader) != "" {
+			streamLimit = wireLimit(limit)
+		}
+		value, err := readStream(res.Body, size, streamLimit)
+		if err == errTooLarge {
+			return tooLarge()
+		}
+		if err != nil {
+			return err
+		}
+		if h.crossZone {
+			h.pool.Stats.CrossZoneBytes.Add(int64(len(value)))
+		}
+		out.Reset()
+		out.Value, out.Codec = value, res.Header.Get(codecHeader)
+		return nil
+	}
+
+	r := io.Reader(res.Body)
+	if limit > 0 {
+		r = io.LimitReader(res.Body, wireLimit(limit)+responseOverhead+1) // 对方不一定遵守limit
+	}
+	bytes, err := io.ReadAll(r)
 	if err != nil {
 		return fmt.Errorf("reading response body: %v", err)
 	}
+	if h.crossZone {
+		h.pool.Stats.CrossZoneBytes.Add(int64(len(bytes)))
+	}
+	if limit > 0 && int64(len(bytes)) > wireLimit(limit)+responseOverhead {
+		return tooLarge()
+	}
 
 	if err = proto.Unmarshal(bytes, out); err != nil {
 		return fmt.Errorf("decoding response body: %v", err)
 	}
+	// 编码过的值由transcode边解码边检查。
+	if limit > 0 && out.GetCodec() == "" && int64(len(out.Value)) > limit {
+		return tooLarge()
+	}
 	return nil
 }
 
+// responseOverhead bounds the size of a marshalled pb.Response beyond its value.
+const responseOverhead = 1 << 10
+
+// Transfer hands cached entries to the peer, which now owns their keys.
+// Cancelling ctx aborts the request.
+func (h *httpGetter) Transfer(ctx context.Context, in *pb.TransferRequest, out *pb.TransferResponse) error {
+	body, err := proto.Marshal(in)
+	if err != nil {
+		return err
+	}
+	res, err := h.do(ctx, http.MethodPost, h.baseURL+transferPath, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned: %v", res.Status)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("reading response body: %v", err)
+	}
+
+	if err = proto.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decoding response body: %v", err)
+	}
+	return nil
+}
+
+// do sends a request marked as coming from our pool, signed if the pool
+// has signing keys, and checks the ring digest the peer sends back.
+func (h *httpGetter) do(ctx context.Context, method, u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	tracing.Inject(ctx, req.Header)
+	req.Header.Set(protocolHeader, protocolVersion)
+	req.Header.Set(acceptStreamHeader, "1")
+	req.Header.Set(acceptCodecHeader, acceptCodecs)
+	if h.pool != nil {
+		req.Header.Set(fromPeerHeader, h.pool.self)
+		if ring := h.pool.ringDigest(); ring != "" {
+			req.Header.Set(ringHeader, ring)
+		}
+		if err := h.pool.signRequest(req, body); err != nil {
+			return nil, err
+		}
+	}
+	res, err := h.pool.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.pool != nil {
+		h.pool.checkRing(h.baseURL, res.Header.Get(ringHeader))
+	}
+	return res, nil
+}
+
 var _ PeerGetter = (*httpGetter)(nil)
@@ -0,0 +1,83 @@
+package geecache
+
+// 以前每次命中、每个请求、每次选peer都用log.Println打出来，线上日志被刷屏，也没法按级别过滤。
+// 现在Group和HTTPPool都写到一个*slog.Logger，默认什么都不打。
+//
+// 级别约定：命中、未命中、加载、转发这些每个请求都有的事件是Debug，节点变化是Info，
+// 失败但还能兜底的（peer出错、ring不一致）是Warn，丢数据的（磁盘、snapshot）是Error。
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+)
+
+var quietLogger = slog.New(slog.DiscardHandler)
+
+// WithLogger makes the group log to l. Nothing is logged by default.
+func WithLogger(l *slog.Logger) GroupOption {
+	return func(g *Group) {
+		g.logger = l
+	}
+}
+
+// WithPoolLogger makes the pool log to l. Nothing is logged by default.
+func WithPoolLogger(l *slog.Logger) PoolOption {
+	return func(p *HTTPPool) {
+		p.logger = l
+	}
+}
+
+// keyAttr identifies key in logs by its hash: keys may be personal data,
+// or binary. The hash is only computed if the record is written.
+func keyAttr(key string) slog.Attr {
+	return slog.Any("key_hash", hashedKey(key))
+}
+
+// hashedKey logs as the hash of the key.
+type hashedKey string
+
+func (k hashedKey) LogValue() slog.Value {
+	return slog.StringValue(keyHash(string(k)))
+}
+
+func keyHash(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// NewSamplingHandler returns a handler that passes the records at or
+// above level on to h, and only the first of every n of the others, which
+// keeps high-volume debug events such as hits from flooding the logs.
+func NewSamplingHandler(h slog.Handler, level slog.Leveler, n uint64) slog.Handler {
+	return &samplingHandler{h: h, level: level, n: n, count: new(atomic.Uint64)}
+}
+
+type samplingHandler struct {
+	h     slog.Handler
+	level slog.Leveler
+	n     uint64
+	count *atomic.Uint64 // shared with the handlers made by WithAttrs and WithGroup
+}
+
+func (s *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.h.Enabled(ctx, level)
+}
+
+func (s *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < s.level.Level() && s.n > 1 && (s.count.Add(1)-1)%s.n != 0 {
+		return nil
+	}
+	return s.h.Handle(ctx, r)
+}
+
+func (s *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{h: s.h.WithAttrs(attrs), level: s.level, n: s.n, count: s.count}
+}
+
+func (s *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{h: s.h.WithGroup(name), level: s.level, n: s.n, count: s.count}
+}
@@ -1,23 +1,25 @@
 package lru
 
-import "container/list"
-
 // Cache is an LRU cache. It is not safe for concurrent access.
 // 一共实现4个操作：查 改增 删
 // 缓存都是通过键值对的形式存储的。
-type Cache struct { // Cache首字母大写，是为了让cache.go使用
-	maxBytes int64                    // 最大存储的byte数目
-	nbytes   int64                    // 已存储的byte数目（包括key的byte数目+value的byte数目）
-	ll       *list.List               // 元素是entry。不用链表不能完成“访问时更新”。
-	cache    map[string]*list.Element // 这是键值对的键到值的映射。有了这个，可以键直接访问值
+// K和V是泛型参数，value直接存在链表节点里，不用装箱成interface，也不用再做类型断言。
+type Cache[K comparable, V any] struct { // Cache首字母大写，是为了让cache.go使用
+	maxBytes int64                // 最大存储的byte数目
+	nbytes   int64                // 已存储的byte数目（sizeOf算出来的大小+每个entry的额外开销）
+	overhead int64                // 每个entry额外计入的byte数目，见SetEntryOverhead
+	sizeOf   func(K, V) int64     // 一个entry的key和value占多少byte
+	root     element[K, V]        // 链表的哨兵。root.next是front（最新），root.prev是back（最旧）。不用链表不能完成“访问时更新”。
+	cache    map[K]*element[K, V] // 这是键值对的键到值的映射。有了这个，可以键直接访问值
 	// optional and executed when an entry is purged.
-	OnEvicted func(key string, value Value) // 删除某元素之后，可能需要对于被删除元素进行操作。（比如打印被删除元素）
+	OnEvicted func(key K, value V) // 删除某元素之后，可能需要对于被删除元素进行操作。（比如打印被删除元素）
 }
 
-// entry是节点数据类型
-type entry struct {
-	key   string
-	value Value
+// element是链表节点，同时也是entry，一个entry只有这一次分配。
+type element[K comparable, V any] struct {
+	prev, next *element[K, V]
+	key        K
+	value      V
 }
 
 // Value use Len to count how many bytes it takes
@@ -25,29 +27,82 @@ type Value interface {
 	Len() int
 }
 
-// New is the Constructor of Cache
-func New(maxBytes int64, onEvicted func(string, Value)) *Cache {
-	return &Cache{
+// ValueCache is the cache of string keys and Value values this package
+// offered before Cache was generic. New creates one.
+type ValueCache = Cache[string, Value]
+
+// EntryOverhead is the heap memory an entry of a ValueCache takes on a
+// 64-bit platform besides its key and value bytes: the element and its
+// share of the map, measured with runtime.MemStats over many entries.
+// Values whose dynamic type is not a pointer are boxed when stored in a
+// Value, which costs another allocation on top of this.
+const EntryOverhead = 80
+
+// New is the Constructor of ValueCache. An entry counts the length of its
+// key plus the Len of its value toward maxBytes.
+func New(maxBytes int64, onEvicted func(string, Value)) *ValueCache {
+	return NewCache(maxBytes, func(key string, value Value) int64 {
+		return int64(len(key)) + int64(value.Len()) // 对于ASCII字符来说，一个字节就是一个字符。len获得的就是字节数目。
+	}, onEvicted)
+}
+
+// NewCache creates a cache whose entries count sizeOf(key, value) bytes
+// toward maxBytes. A maxBytes of zero means no limit.
+func NewCache[K comparable, V any](maxBytes int64, sizeOf func(K, V) int64, onEvicted func(K, V)) *Cache[K, V] {
+	c := &Cache[K, V]{
 		maxBytes:  maxBytes,
-		ll:        list.New(),
-		cache:     make(map[string]*list.Element),
+		sizeOf:    sizeOf,
+		cache:     make(map[K]*element[K, V]),
 		OnEvicted: onEvicted,
 	}
+	c.root.next = &c.root
+	c.root.prev = &c.root
+	return c
+}
+
+// pushFront和moveToFront：该项目里面约定：front是队尾，从front入，从tail出。国外翻译直接，所以首进尾出。
+func (c *Cache[K, V]) pushFront(e *element[K, V]) {
+	e.prev = &c.root
+	e.next = c.root.next
+	e.prev.next = e
+	e.next.prev = e
+}
+
+func (c *Cache[K, V]) unlink(e *element[K, V]) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.prev, e.next = nil, nil
+}
+
+func (c *Cache[K, V]) moveToFront(e *element[K, V]) {
+	if c.root.next == e {
+		return
+	}
+	c.unlink(e)
+	c.pushFront(e)
+}
+
+// back returns the oldest element, or nil if the cache is empty.
+func (c *Cache[K, V]) back() *element[K, V] {
+	if c.root.prev == &c.root {
+		return nil
+	}
+	return c.root.prev
 }
 
 // Add adds a value to the cache.
 // 如果是已经存在的key，排头+更新值
 // 否则排头存入新key
-func (c *Cache) Add(key string, value Value) {
-	if ele, ok := c.cache[key]; ok {
-		c.ll.MoveToFront(ele) // 该项目里面约定：front是队尾，从front入，从tail出。国外翻译直接，所以首进尾出。
-		kv := ele.Value.(*entry)
-		c.nbytes += int64(value.Len()) - int64(kv.value.Len())
-		kv.value = value
+func (c *Cache[K, V]) Add(key K, value V) {
+	if e, ok := c.cache[key]; ok {
+		c.moveToFront(e)
+		c.nbytes += c.sizeOf(key, value) - c.sizeOf(key, e.value)
+		e.value = value
 	} else {
-		ele := c.ll.PushFront(&entry{key, value})
-		c.cache[key] = ele
-		c.nbytes += int64(len(key)) + int64(value.Len()) // 对于ASCII字符来说，一个字节就是一个字符。len获得的就是字节数目。
+		e := &element[K, V]{key: key, value: value}
+		c.pushFront(e)
+		c.cache[key] = e
+		c.nbytes += c.sizeOf(key, value) + c.overhead
 	}
 	for c.maxBytes != 0 && c.maxBytes < c.nbytes { // 这里的maxBytes!=0的检验是便于测试验证，实际上不应该有!=0的验证
 		c.RemoveOldest()
@@ -55,33 +110,105 @@ func (c *Cache) Add(key string, value Value) {
 }
 
 // Get looks up a key's value
-func (c *Cache) Get(key string) (value Value, ok bool) {
-	if ele, ok := c.cache[key]; ok {
-		c.ll.MoveToFront(ele)    // 查的时候也要排到前面
-		kv := ele.Value.(*entry) // 这里是强制类型转换
-		return kv.value, true
+func (c *Cache[K, V]) Get(key K) (value V, ok bool) {
+	if e, ok := c.cache[key]; ok {
+		c.moveToFront(e) // 查的时候也要排到前面
+		return e.value, true
+	}
+	return
+}
+
+// Peek looks up a key's value without updating its recency.
+func (c *Cache[K, V]) Peek(key K) (value V, ok bool) {
+	if e, ok := c.cache[key]; ok {
+		return e.value, true
 	}
 	return
 }
 
+// Contains reports whether key is in the cache, without updating its recency.
+func (c *Cache[K, V]) Contains(key K) bool {
+	_, ok := c.cache[key]
+	return ok
+}
+
+// GetOldest returns the oldest entry without updating its recency.
+func (c *Cache[K, V]) GetOldest() (key K, value V, ok bool) {
+	if e := c.back(); e != nil {
+		return e.key, e.value, true
+	}
+	return
+}
+
+// Remove removes the provided key from the cache.
+func (c *Cache[K, V]) Remove(key K) {
+	if e, ok := c.cache[key]; ok {
+		c.removeElement(e)
+	}
+}
+
 // RemoveOldest removes the oldest item
-func (c *Cache) RemoveOldest() {
-	ele := c.ll.Back()
-	if ele != nil {
-		c.ll.Remove(ele) // 链表去除
+func (c *Cache[K, V]) RemoveOldest() {
+	if e := c.back(); e != nil {
+		c.removeElement(e)
+	}
+}
 
-		kv := ele.Value.(*entry)
-		delete(c.cache, kv.key) // map去除
+func (c *Cache[K, V]) removeElement(e *element[K, V]) {
+	c.unlink(e)            // 链表去除
+	delete(c.cache, e.key) // map去除
 
-		c.nbytes -= int64(len(kv.key)) + int64(kv.value.Len())
+	c.nbytes -= c.sizeOf(e.key, e.value) + c.overhead
 
-		if c.OnEvicted != nil {
-			c.OnEvicted(kv.key, kv.value)
-		}
+	if c.OnEvicted != nil {
+		c.OnEvicted(e.key, e.value)
+	}
+}
+
+// Purge removes every entry from the cache, from the oldest to the newest,
+// calling OnEvicted for each of them.
+func (c *Cache[K, V]) Purge() {
+	for len(c.cache) > 0 {
+		c.RemoveOldest()
 	}
 }
 
 // Len the number of cache entries
-func (c *Cache) Len() int {
-	return c.ll.Len()
+func (c *Cache[K, V]) Len() int {
+	return len(c.cache)
+}
+
+// Bytes returns the number of bytes counted toward maxBytes.
+func (c *Cache[K, V]) Bytes() int64 {
+	return c.nbytes
+}
+
+// Resize changes maxBytes, evicting the oldest entries until the cache
+// fits in it.
+func (c *Cache[K, V]) Resize(maxBytes int64) {
+	c.maxBytes = maxBytes
+	for c.maxBytes != 0 && c.maxBytes < c.nbytes {
+		c.RemoveOldest()
+	}
+}
+
+// SetEntryOverhead makes every entry count n more bytes toward maxBytes
+// than its key and value, e.g. EntryOverhead, so that maxBytes bounds the
+// memory the cache really uses. Entries already in the cache are counted
+// again, and the oldest ones are evicted if they no longer fit.
+func (c *Cache[K, V]) SetEntryOverhead(n int64) {
+	c.nbytes += (n - c.overhead) * int64(len(c.cache))
+	c.overhead = n
+	for c.maxBytes != 0 && c.maxBytes < c.nbytes {
+		c.RemoveOldest()
+	}
+}
+
+// Keys returns the keys in the cache from the oldest to the newest.
+func (c *Cache[K, V]) Keys() []K {
+	keys := make([]K, 0, len(c.cache))
+	for e := c.root.prev; e != &c.root; e = e.prev {
+		keys = append(keys, e.key)
+	}
+	return keys
 }
@@ -1,7 +1,10 @@
 package lru
 
 import (
+	"fmt"
 	"reflect"
+	"runtime"
+	"strconv"
 	"testing"
 )
 
@@ -63,3 +66,205 @@ func TestAdd(t *testing.T) {
 		t.Fatal("expected 6 but got", lru.nbytes)
 	}
 }
+
+func TestKeys(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("k1", String("1"))
+	lru.Add("k2", String("2"))
+	lru.Add("k3", String("3"))
+	lru.Get("k1")
+
+	expect := []string{"k2", "k3", "k1"}
+	if keys := lru.Keys(); !reflect.DeepEqual(keys, expect) {
+		t.Fatalf("expect keys %v, but %v got", expect, keys)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("key1", String("1234"))
+	lru.Add("k2", String("k2"))
+	lru.Remove("key1")
+	lru.Remove("missing")
+
+	if _, ok := lru.Get("key1"); ok || lru.Len() != 1 || lru.nbytes != 4 {
+		t.Fatalf("Remove key1 failed")
+	}
+}
+
+func TestEntryOverhead(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("k1", String("1"))
+	lru.Add("k2", String("2"))
+	lru.SetEntryOverhead(10)
+	if lru.Bytes() != 2*(2+1+10) {
+		t.Fatalf("expected existing entries to be counted again, got %d bytes", lru.Bytes())
+	}
+	lru.Add("k3", String("3"))
+	lru.Remove("k1")
+	if lru.Bytes() != 2*(2+1+10) {
+		t.Fatalf("expected %d bytes, got %d", 2*(2+1+10), lru.Bytes())
+	}
+
+	lru = New(int64(30), nil)
+	lru.Add("k1", String("1"))
+	lru.Add("k2", String("2"))
+	lru.SetEntryOverhead(20)
+	if _, ok := lru.Get("k1"); ok || lru.Len() != 1 {
+		t.Fatalf("expected k1 to be evicted once entries cost more")
+	}
+}
+
+type pointerValue struct{}
+
+func (*pointerValue) Len() int { return 0 }
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// TestEntryOverheadCalibration checks EntryOverhead against the heap an
+// entry really takes.
+func TestEntryOverheadCalibration(t *testing.T) {
+	if strconv.IntSize != 64 {
+		t.Skip("EntryOverhead is calibrated for 64-bit platforms")
+	}
+	const n = 100000
+	keys := make([]string, n)
+	value := &pointerValue{}
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%015d", i)
+	}
+
+	before := heapAlloc()
+	lru := New(int64(0), nil)
+	for _, key := range keys {
+		lru.Add(key, value)
+	}
+	perEntry := float64(heapAlloc()-before) / n
+	runtime.KeepAlive(lru)
+
+	if perEntry < EntryOverhead*0.7 || perEntry > EntryOverhead*1.4 {
+		t.Fatalf("an entry takes %.0f bytes of heap, EntryOverhead is %d", perEntry, EntryOverhead)
+	}
+}
+
+func TestResize(t *testing.T) {
+	var evicted []string
+	lru := New(int64(0), func(key string, value Value) { evicted = append(evicted, key) })
+	lru.Add("k1", String("1"))
+	lru.Add("k2", String("2"))
+	lru.Add("k3", String("3"))
+
+	lru.Resize(6)
+	if expect := []string{"k1"}; !reflect.DeepEqual(evicted, expect) || lru.Bytes() != 6 {
+		t.Fatalf("expect %v evicted down to 6 bytes, got %v and %d bytes", expect, evicted, lru.Bytes())
+	}
+	lru.Resize(100)
+	lru.Add("k4", String("4"))
+	if lru.Len() != 3 {
+		t.Fatalf("expect room for 3 entries after growing, got %d", lru.Len())
+	}
+}
+
+func TestPeekContains(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("k1", String("1"))
+	lru.Add("k2", String("2"))
+
+	if v, ok := lru.Peek("k1"); !ok || string(v.(String)) != "1" {
+		t.Fatalf("Peek k1 failed")
+	}
+	if _, ok := lru.Peek("missing"); ok || lru.Contains("missing") || !lru.Contains("k1") {
+		t.Fatalf("Contains failed")
+	}
+	// Neither Peek nor Contains makes k1 recently used.
+	if key, _, ok := lru.GetOldest(); !ok || key != "k1" {
+		t.Fatalf("expect k1 to stay the oldest, but %q got", key)
+	}
+	if _, _, ok := New(int64(0), nil).GetOldest(); ok {
+		t.Fatalf("GetOldest of an empty cache should fail")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	var keys []string
+	lru := New(int64(0), func(key string, value Value) {
+		keys = append(keys, key)
+	})
+	lru.Add("k1", String("1"))
+	lru.Add("k2", String("2"))
+	lru.Purge()
+
+	if lru.Len() != 0 || lru.Bytes() != 0 || !reflect.DeepEqual(keys, []string{"k1", "k2"}) {
+		t.Fatalf("Purge left %d entries and evicted %v", lru.Len(), keys)
+	}
+}
+
+// view is shaped like geecache.ByteView: a struct that has to be boxed
+// to be stored as a Value.
+type view struct {
+	b []byte
+	s string
+}
+
+func (v view) Len() int { return len(v.b) + len(v.s) }
+
+func benchKeys() []string {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	return keys
+}
+
+func BenchmarkAdd(b *testing.B) {
+	keys := benchKeys()
+	v := view{s: "value"}
+	b.Run("Value", func(b *testing.B) {
+		b.ReportAllocs()
+		c := New(1<<10, nil)
+		for i := 0; i < b.N; i++ {
+			c.Add(keys[i%len(keys)], v)
+		}
+	})
+	b.Run("generic", func(b *testing.B) {
+		b.ReportAllocs()
+		c := NewCache(1<<10, func(key string, v view) int64 { return int64(len(key) + v.Len()) }, nil)
+		for i := 0; i < b.N; i++ {
+			c.Add(keys[i%len(keys)], v)
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	keys := benchKeys()
+	v := view{s: "value"}
+	b.Run("Value", func(b *testing.B) {
+		b.ReportAllocs()
+		c := New(0, nil)
+		for _, key := range keys {
+			c.Add(key, v)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			got, _ := c.Get(keys[i%len(keys)])
+			_ = got.(view)
+		}
+	})
+	b.Run("generic", func(b *testing.B) {
+		b.ReportAllocs()
+		c := NewCache(0, func(key string, v view) int64 { return int64(len(key) + v.Len()) }, nil)
+		for _, key := range keys {
+			c.Add(key, v)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c.Get(keys[i%len(keys)])
+		}
+	})
+}
@@ -0,0 +1,628 @@
+// Package membership implements SWIM-style gossip membership, so geecache
+// nodes can find each other from a list of seeds and notice when a node
+// fails.
+//
+// Every ProbeInterval a member pings another member. If no ack arrives
+// within ProbeTimeout it asks IndirectProbes other members to ping the
+// target on its behalf. If that fails too the target becomes suspect, and
+// a suspect that doesn't refute the suspicion within SuspicionTimeout is
+// declared dead. State changes ride along on the protocol messages.
+package membership
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State is the state of a member as seen by the local member.
+type State int
+
+const (
+	StateAlive State = iota
+	StateSuspect
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Member is a node of the cluster.
+type Member struct {
+	Name        string
+	Addr        string // transport address
+	Meta        string // application data, the geecache peer URL
+	State       State
+	Incarnation uint64 // only the member itself increases it, to refute suspicion
+}
+
+// Config configures a Memberlist.
+type Config struct {
+	Name      string    // unique name of this member, defaults to the transport address
+	Meta      string    // e.g. "http://localhost:8001"
+	Seeds     []string  // transport addresses of members to join through
+	Transport Transport // required
+
+	ProbeInterval    time.Duration // defaults to 1s
+	ProbeTimeout     time.Duration // defaults to ProbeInterval/3
+	IndirectProbes   int           // defaults to 3
+	SuspicionTimeout time.Duration // defaults to 5*ProbeInterval
+
+	Logger *slog.Logger // nothing is logged by default
+}
+
+type msgType int
+
+const (
+	pingMsg msgType = iota
+	pingReqMsg
+	ackMsg
+)
+
+// message is the wire format of every protocol message.
+type message struct {
+	Type    msgType  `json:"type"`
+	Seq     uint64   `json:"seq"`
+	From    Member   `json:"from"`
+	Target  string   `json:"target,omitempty"` // address to probe, for pingReqMsg
+	Updates []Member `json:"updates,omitempty"`
+}
+
+// broadcast is a state change waiting to be piggybacked on messages.
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+// maxPiggyback is the number of updates carried by one message.
+const maxPiggyback = 8
+
+// A Memberlist tracks the members of a cluster.
+type Memberlist struct {
+	config    Config
+	transport Transport
+	logger    *slog.Logger
+
+	mu         sync.Mutex
+	self       string
+	members    map[string]*Member
+	probeOrder []string
+	probeIdx   int
+	seq        uint64
+	ackWaiters map[uint64]chan struct{}
+	suspicions map[string]*time.Timer
+	broadcasts []*broadcast
+	watchers   []chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+	wg         sync.WaitGroup
+	rnd        *rand.Rand
+}
+
+// New creates a member, starts the protocol and starts joining the seeds.
+func New(config Config) (*Memberlist, error) {
+	if config.Transport == nil {
+		return nil, errors.New("membership: nil Transport")
+	}
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = time.Second
+	}
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = config.ProbeInterval / 3
+	}
+	if config.IndirectProbes <= 0 {
+		config.IndirectProbes = 3
+	}
+	if config.SuspicionTimeout <= 0 {
+		config.SuspicionTimeout = 5 * config.ProbeInterval
+	}
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.DiscardHandler)
+	}
+	addr := config.Transport.Addr()
+	if config.Name == "" {
+		config.Name = addr
+	}
+
+	m := &Memberlist{
+		config:     config,
+		transport:  config.Transport,
+		logger:     config.Logger.With("member", config.Name),
+		self:       config.Name,
+		members:    make(map[string]*Member),
+		ackWaiters: make(map[uint64]chan struct{}),
+		suspicions: make(map[string]*time.Timer),
+		stop:       make(chan struct{}),
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	m.members[m.self] = &Member{Name: m.self, Addr: addr, Meta: config.Meta, State: StateAlive}
+
+	m.wg.Add(2)
+	go m.receiveLoop()
+	go m.probeLoop()
+	m.joinSeeds()
+	return m, nil
+}
+
+// LocalMember returns this member.
+func (m *Memberlist) LocalMember() Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return *m.members[m.self]
+}
+
+// Members returns the live members, alive or suspect, sorted by name.
+func (m *Memberlist) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var live []Member
+	for _, mem := range m.members {
+		if mem.State != StateDead {
+			live = append(live, *mem)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].Name < live[j].Name })
+	return live
+}
+
+// Peers returns the sorted Meta of the live members.
+func (m *Memberlist) Peers() []string {
+	var peers []string
+	for _, mem := range m.Members() {
+		if mem.Meta != "" {
+			peers = append(peers, mem.Meta)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Watch sends the live peers and then every change to them, so a
+// Memberlist can feed an HTTPPool through HTTPPool.Watch.
+func (m *Memberlist) Watch(ctx context.Context) (<-chan []string, error) {
+	changed := make(chan struct{}, 1)
+	m.mu.Lock()
+	m.watchers = append(m.watchers, changed)
+	m.mu.Unlock()
+
+	ch := make(chan []string)
+	go func() {
+		defer close(ch)
+		defer m.unwatch(changed)
+
+		var last []string
+		for {
+			if peers := m.Peers(); last == nil || !slices.Equal(peers, last) {
+				if peers == nil {
+					peers = []string{}
+				}
+				select {
+				case ch <- peers:
+					last = peers
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (m *Memberlist) unwatch(changed chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchers = slices.DeleteFunc(m.watchers, func(c chan struct{}) bool { return c == changed })
+}
+
+// notify wakes up the watchers. m.mu must be held.
+func (m *Memberlist) notify() {
+	for _, c := range m.watchers {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Leave tells the other members that this member is leaving, then shuts
+// it down. Without Leave the others only find out through failed probes.
+func (m *Memberlist) Leave() error {
+	m.mu.Lock()
+	self := m.members[m.self]
+	self.State = StateDead
+	leave := message{Type: pingMsg, From: *self, Updates: []Member{*self}}
+	var addrs []string
+	for _, mem := range m.members {
+		if mem.Name != m.self && mem.State != StateDead {
+			addrs = append(addrs, mem.Addr)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, addr := range addrs {
+		m.send(addr, leave)
+	}
+	return m.Shutdown()
+}
+
+// Shutdown stops the protocol and closes the transport without telling
+// the other members.
+func (m *Memberlist) Shutdown() error {
+	var err error
+	m.stopOnce.Do(func() {
+		close(m.stop)
+		err = m.transport.Close()
+		m.wg.Wait()
+
+		m.mu.Lock()
+		for _, t := range m.suspicions {
+			t.Stop()
+		}
+		m.mu.Unlock()
+	})
+	return err
+}
+
+func (m *Memberlist) joinSeeds() {
+	m.mu.Lock()
+	self := *m.members[m.self]
+	m.mu.Unlock()
+
+	for _, seed := range m.config.Seeds {
+		if seed != self.Addr {
+			m.send(seed, message{Type: pingMsg, From: self})
+		}
+	}
+}
+
+func (m *Memberlist) receiveLoop() {
+	defer m.wg.Done()
+	for {
+		select {
+		case raw := <-m.transport.Packets():
+			var msg message
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				m.logger.Warn("bad message", "error", err)
+				continue
+			}
+			m.handle(msg)
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *Memberlist) handle(msg message) {
+	m.mu.Lock()
+	known, wasKnown := m.members[msg.From.Name]
+	// 对方眼里的自己可能已经过时（例如我们怀疑它或认为它已死），把我们的记录回给它，让它有机会反驳。
+	var stale *Member
+	if wasKnown && known.State != StateAlive && known.Incarnation >= msg.From.Incarnation {
+		c := *known
+		stale = &c
+	}
+	m.merge(msg.From)
+	for _, u := range msg.Updates {
+		m.merge(u)
+	}
+	m.mu.Unlock()
+
+	switch msg.Type {
+	case pingMsg:
+		ack := m.newMessage(ackMsg, msg.Seq)
+		if !wasKnown {
+			ack.Updates = append(ack.Updates, m.snapshot()...)
+		}
+		if stale != nil {
+			ack.Updates = append(ack.Updates, *stale)
+		}
+		m.send(msg.From.Addr, ack)
+	case pingReqMsg:
+		go m.relay(msg.From.Addr, msg.Seq, msg.Target)
+	case ackMsg:
+		m.mu.Lock()
+		if ch, ok := m.ackWaiters[msg.Seq]; ok {
+			delete(m.ackWaiters, msg.Seq)
+			close(ch)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// relay pings target on behalf of origin and forwards the ack.
+func (m *Memberlist) relay(origin string, seq uint64, target string) {
+	if m.ping(target, m.config.ProbeTimeout) {
+		m.send(origin, m.newMessage(ackMsg, seq))
+	}
+}
+
+// merge applies what another member told us about member u. m.mu must be held.
+func (m *Memberlist) merge(u Member) {
+	if u.Name == "" {
+		return
+	}
+	if u.Name == m.self {
+		self := m.members[m.self]
+		if u.State != StateAlive && u.Incarnation >= self.Incarnation && self.State == StateAlive {
+			// 有人怀疑我们，提高incarnation进行反驳。
+			self.Incarnation = u.Incarnation + 1
+			m.queue(*self)
+		}
+		return
+	}
+
+	cur, ok := m.members[u.Name]
+	if !ok {
+		if u.State == StateDead {
+			return
+		}
+		mem := u
+		m.members[u.Name] = &mem
+		m.probeOrder = append(m.probeOrder, u.Name)
+		if u.State == StateSuspect {
+			m.startSuspicion(u.Name, u.Incarnation)
+		}
+		m.queue(u)
+		m.notify()
+		return
+	}
+
+	if !overrides(u, *cur) {
+		return
+	}
+	wasLive, oldMeta := cur.State != StateDead, cur.Meta
+	*cur = u
+	switch u.State {
+	case StateSuspect:
+		m.startSuspicion(u.Name, u.Incarnation)
+	default:
+		m.stopSuspicion(u.Name)
+	}
+	if u.State == StateDead {
+		m.logger.Info("member is dead", "member", u.Name)
+	}
+	m.queue(u)
+	if wasLive != (u.State != StateDead) || oldMeta != u.Meta {
+		m.notify()
+	}
+}
+
+// overrides reports whether update u supersedes what we know in cur,
+// following the SWIM rules: a higher incarnation always wins, and at the
+// same incarnation suspect beats alive and dead beats both.
+func overrides(u, cur Member) bool {
+	if u.Incarnation != cur.Incarnation {
+		return u.Incarnation > cur.Incarnation
+	}
+	return u.State > cur.State
+}
+
+// queue schedules u to be gossiped. m.mu must be held.
+func (m *Memberlist) queue(u Member) {
+	m.broadcasts = slices.DeleteFunc(m.broadcasts, func(b *broadcast) bool { return b.member.Name == u.Name })
+	m.broadcasts = append(m.broadcasts, &broadcast{member: u})
+}
+
+// piggyback picks the updates to carry on the next message. m.mu must be held.
+func (m *Memberlist) piggyback() []Member {
+	// 每条更新大约发送 3*log2(n) 次，足以让整个集群以很高的概率收到。
+	limit := 3
+	for n := len(m.members); n > 1; n /= 2 {
+		limit += 3
+	}
+
+	var updates []Member
+	for _, b := range m.broadcasts {
+		if len(updates) == maxPiggyback {
+			break
+		}
+		updates = append(updates, b.member)
+		b.transmits++
+	}
+	m.broadcasts = slices.DeleteFunc(m.broadcasts, func(b *broadcast) bool { return b.transmits >= limit })
+	return updates
+}
+
+// snapshot returns every member we know about.
+func (m *Memberlist) snapshot() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	all := make([]Member, 0, len(m.members))
+	for _, mem := range m.members {
+		all = append(all, *mem)
+	}
+	return all
+}
+
+func (m *Memberlist) startSuspicion(name string, incarnation uint64) {
+	if _, ok := m.suspicions[name]; ok {
+		return
+	}
+	m.suspicions[name] = time.AfterFunc(m.config.SuspicionTimeout, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		delete(m.suspicions, name)
+		mem, ok := m.members[name]
+		if !ok || mem.State != StateSuspect || mem.Incarnation != incarnation {
+			return
+		}
+		m.merge(Member{Name: name, Addr: mem.Addr, Meta: mem.Meta, State: StateDead, Incarnation: incarnation})
+	})
+}
+
+func (m *Memberlist) stopSuspicion(name string) {
+	if t, ok := m.suspicions[name]; ok {
+		t.Stop()
+		delete(m.suspicions, name)
+	}
+}
+
+func (m *Memberlist) newMessage(typ msgType, seq uint64) message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return message{Type: typ, Seq: seq, From: *m.members[m.self], Updates: m.piggyback()}
+}
+
+func (m *Memberlist) send(addr string, msg message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		m.logger.Error("encoding message failed", "error", err)
+		return
+	}
+	if err := m.transport.Send(addr, data); err != nil {
+		m.logger.Warn("sending message failed", "addr", addr, "error", err)
+	}
+}
+
+// waitAck registers a waiter for an ack with a fresh sequence number.
+func (m *Memberlist) waitAck() (uint64, chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	ch := make(chan struct{})
+	m.ackWaiters[m.seq] = ch
+	return m.seq, ch
+}
+
+func (m *Memberlist) cancelAck(seq uint64) {
+	m.mu.Lock()
+	delete(m.ackWaiters, seq)
+	m.mu.Unlock()
+}
+
+// ping probes addr directly and reports whether it answered in time.
+func (m *Memberlist) ping(addr string, timeout time.Duration) bool {
+	seq, acked := m.waitAck()
+	defer m.cancelAck(seq)
+
+	m.send(addr, m.newMessage(pingMsg, seq))
+	select {
+	case <-acked:
+		return true
+	case <-time.After(timeout):
+		return false
+	case <-m.stop:
+		return false
+	}
+}
+
+func (m *Memberlist) probeLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.config.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.probe()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// nextTarget picks the next member to probe in a shuffled round robin.
+func (m *Memberlist) nextTarget() (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for range len(m.probeOrder) + 1 {
+		if m.probeIdx >= len(m.probeOrder) {
+			m.probeOrder = slices.DeleteFunc(m.probeOrder, func(name string) bool {
+				return m.members[name].State == StateDead
+			})
+			m.rnd.Shuffle(len(m.probeOrder), func(i, j int) {
+				m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+			})
+			m.probeIdx = 0
+			if len(m.probeOrder) == 0 {
+				return Member{}, false
+			}
+		}
+		mem := m.members[m.probeOrder[m.probeIdx]]
+		m.probeIdx++
+		if mem.State != StateDead {
+			return *mem, true
+		}
+	}
+	return Member{}, false
+}
+
+// relays picks up to k live members other than target to probe indirectly.
+func (m *Memberlist) relays(target string, k int) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var addrs []string
+	for name, mem := range m.members {
+		if name != m.self && name != target && mem.State == StateAlive {
+			addrs = append(addrs, mem.Addr)
+		}
+	}
+	m.rnd.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > k {
+		addrs = addrs[:k]
+	}
+	return addrs
+}
+
+func (m *Memberlist) probe() {
+	target, ok := m.nextTarget()
+	if !ok {
+		// 还没有认识任何成员，继续尝试通过种子节点加入。
+		m.joinSeeds()
+		return
+	}
+	if m.ping(target.Addr, m.config.ProbeTimeout) {
+		return
+	}
+
+	seq, acked := m.waitAck()
+	defer m.cancelAck(seq)
+	for _, relay := range m.relays(target.Name, m.config.IndirectProbes) {
+		req := m.newMessage(pingReqMsg, seq)
+		req.Target = target.Addr
+		m.send(relay, req)
+	}
+
+	select {
+	case <-acked:
+		return
+	case <-time.After(m.config.ProbeInterval - m.config.ProbeTimeout):
+	case <-m.stop:
+		return
+	}
+
+	m.mu.Lock()
+	if cur, ok := m.members[target.Name]; ok && cur.State == StateAlive && cur.Incarnation == target.Incarnation {
+		suspect := *cur
+		suspect.State = StateSuspect
+		m.merge(suspect)
+	}
+	m.mu.Unlock()
+}
@@ -0,0 +1,143 @@
+package membership
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testConfig(meta string, t Transport, seeds ...string) Config {
+	return Config{
+		Meta:             meta,
+		Seeds:            seeds,
+		Transport:        t,
+		ProbeInterval:    20 * time.Millisecond,
+		ProbeTimeout:     5 * time.Millisecond,
+		SuspicionTimeout: 60 * time.Millisecond,
+	}
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func startUDP(t *testing.T, n int) []*Memberlist {
+	var nodes []*Memberlist
+	var seed string
+	for i := 0; i < n; i++ {
+		tr, err := NewUDPTransport("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := New(testConfig(fmt.Sprintf("http://localhost:%d", 8001+i), tr, seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seed == "" {
+			seed = tr.Addr()
+		}
+		nodes = append(nodes, m)
+	}
+	t.Cleanup(func() {
+		for _, m := range nodes {
+			m.Shutdown()
+		}
+	})
+	return nodes
+}
+
+func TestJoinAndFailureUDP(t *testing.T) {
+	nodes := startUDP(t, 4)
+	expect := []string{"http://localhost:8001", "http://localhost:8002", "http://localhost:8003", "http://localhost:8004"}
+	for i, m := range nodes {
+		waitFor(t, fmt.Sprintf("node %d to see every member", i), func() bool {
+			return reflect.DeepEqual(m.Peers(), expect)
+		})
+	}
+
+	// Node 3 crashes without saying goodbye; the others must detect it.
+	nodes[3].Shutdown()
+	for i, m := range nodes[:3] {
+		waitFor(t, fmt.Sprintf("node %d to declare node 3 dead", i), func() bool {
+			return reflect.DeepEqual(m.Peers(), expect[:3])
+		})
+	}
+}
+
+func TestLeaveHTTP(t *testing.T) {
+	var nodes []*Memberlist
+	var seed string
+	for i := 0; i < 3; i++ {
+		tr := NewHTTPTransport("")
+		srv := httptest.NewServer(tr)
+		defer srv.Close()
+		tr.addr = srv.URL
+
+		m, err := New(testConfig(fmt.Sprintf("http://localhost:%d", 8001+i), tr, seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Shutdown()
+		if seed == "" {
+			seed = srv.URL
+		}
+		nodes = append(nodes, m)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, _ := nodes[0].Watch(ctx)
+
+	expect := []string{"http://localhost:8001", "http://localhost:8002", "http://localhost:8003"}
+	waitFor(t, "node 0 to report every member", func() bool {
+		select {
+		case peers := <-updates:
+			return reflect.DeepEqual(peers, expect)
+		default:
+			return false
+		}
+	})
+
+	nodes[2].Leave()
+	waitFor(t, "node 0 to report node 2 left", func() bool {
+		select {
+		case peers := <-updates:
+			return reflect.DeepEqual(peers, expect[:2])
+		default:
+			return false
+		}
+	})
+}
+
+func TestRefuteSuspicion(t *testing.T) {
+	nodes := startUDP(t, 2)
+	waitFor(t, "nodes to meet", func() bool { return len(nodes[1].Members()) == 2 })
+
+	// Node 1 wrongly suspects node 0, which must refute with a higher incarnation.
+	self := nodes[0].LocalMember()
+	nodes[1].mu.Lock()
+	suspect := *nodes[1].members[self.Name]
+	suspect.State = StateSuspect
+	nodes[1].merge(suspect)
+	nodes[1].mu.Unlock()
+
+	waitFor(t, "node 0 to refute", func() bool {
+		for _, mem := range nodes[1].Members() {
+			if mem.Name == self.Name {
+				return mem.State == StateAlive && mem.Incarnation > self.Incarnation
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,159 @@
+package membership
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maxPacketSize bounds a single membership message.
+const maxPacketSize = 64 << 10
+
+// Transport is the interface that must be implemented to carry membership
+// messages between members. Delivery is best effort: messages may be
+// lost, and the protocol is built to tolerate that.
+type Transport interface {
+	// Addr returns the address other members use to reach this one.
+	Addr() string
+	// Send delivers msg to the member listening on addr without waiting for a reply.
+	Send(addr string, msg []byte) error
+	// Packets returns the channel of incoming messages.
+	Packets() <-chan []byte
+	// Close stops receiving messages.
+	Close() error
+}
+
+// UDPTransport sends every message as one UDP datagram.
+type UDPTransport struct {
+	conn    *net.UDPConn
+	packets chan []byte
+}
+
+// NewUDPTransport listens on the UDP address addr, e.g. "127.0.0.1:7946".
+// Use port 0 to pick a free port.
+func NewUDPTransport(addr string) (*UDPTransport, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &UDPTransport{conn: conn, packets: make(chan []byte, 64)}
+	go t.readLoop()
+	return t, nil
+}
+
+func (t *UDPTransport) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			return // conn closed
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		select {
+		case t.packets <- msg:
+		default: // 来不及处理就丢掉，和网络丢包一样由协议本身兜底。
+		}
+	}
+}
+
+// Addr returns the local UDP address.
+func (t *UDPTransport) Addr() string {
+	return t.conn.LocalAddr().String()
+}
+
+// Send writes msg as a datagram to addr.
+func (t *UDPTransport) Send(addr string, msg []byte) error {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.WriteToUDP(msg, raddr)
+	return err
+}
+
+// Packets returns the channel of incoming datagrams.
+func (t *UDPTransport) Packets() <-chan []byte {
+	return t.packets
+}
+
+// Close closes the UDP socket.
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
+
+// HTTPTransport sends every message as an HTTP POST. It is an
+// http.Handler that must be served at the URL passed to NewHTTPTransport.
+type HTTPTransport struct {
+	addr    string
+	client  *http.Client
+	packets chan []byte
+	done    chan struct{}
+}
+
+// NewHTTPTransport returns a transport reachable at the URL addr, e.g.
+// "http://localhost:8001/_swim/".
+func NewHTTPTransport(addr string) *HTTPTransport {
+	return &HTTPTransport{
+		addr:    addr,
+		client:  &http.Client{Timeout: time.Second},
+		packets: make(chan []byte, 64),
+		done:    make(chan struct{}),
+	}
+}
+
+// ServeHTTP receives a message posted by another member.
+func (t *HTTPTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	msg, err := io.ReadAll(io.LimitReader(r.Body, maxPacketSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case t.packets <- msg:
+	case <-t.done:
+	default:
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Addr returns the URL of this transport.
+func (t *HTTPTransport) Addr() string {
+	return t.addr
+}
+
+// Send posts msg to the transport at the URL addr. The request is made in
+// the background so a slow member can't stall the protocol.
+func (t *HTTPTransport) Send(addr string, msg []byte) error {
+	go func() {
+		res, err := t.client.Post(addr, "application/json", bytes.NewReader(msg))
+		if err != nil {
+			return
+		}
+		res.Body.Close()
+	}()
+	return nil
+}
+
+// Packets returns the channel of incoming messages.
+func (t *HTTPTransport) Packets() <-chan []byte {
+	return t.packets
+}
+
+// Close stops accepting messages.
+func (t *HTTPTransport) Close() error {
+	close(t.done)
+	return nil
+}
@@ -0,0 +1,68 @@
+package geecache
+
+// cacheBytes只算key和value的字节数，链表节点、entry、map、ByteView本身都没算进去，
+// 配置2<<10实际可能占用好几倍的内存。WithMemoryLimit让group按真实内存计数：每个entry加上校准过的额外开销，
+// 并且定期对照runtime/metrics里的堆大小，超了就淘汰。
+
+import (
+	"geecache/lru"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// entryOverhead is what a cached entry costs besides its key and value
+// bytes: lru.EntryOverhead assumes a 16 byte interface value in each
+// element, while mainCache keeps a ByteView and its expiry inline, 48
+// bytes, which moves the element from the 48 to the 80 byte size class.
+const entryOverhead = lru.EntryOverhead + 32
+
+// memoryCheckInterval is how often, at most, a group with a memory limit
+// reads the heap size.
+const memoryCheckInterval = 100 * time.Millisecond
+
+// WithMemoryLimit sizes the group's caches in real memory: limit replaces
+// cacheBytes, and every entry counts its bookkeeping overhead on top of
+// its key and value. The live heap reported by runtime/metrics is also
+// checked against limit; while it is above, new entries make the group
+// evict its oldest ones, which matters when a node runs a single group.
+func WithMemoryLimit(limit int64) GroupOption {
+	return func(g *Group) {
+		g.memoryLimit = limit
+		g.mainCache.cacheBytes = limit - limit/8
+		g.hotCache.cacheBytes = limit / 8
+		g.mainCache.entryOverhead = entryOverhead
+		g.hotCache.entryOverhead = entryOverhead
+	}
+}
+
+// checkMemory evicts entries while the live heap is above the group's
+// memory limit.
+func (g *Group) checkMemory() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&g.memoryChecked)
+	if now-last < int64(memoryCheckInterval) || !atomic.CompareAndSwapInt64(&g.memoryChecked, last, now) {
+		return
+	}
+
+	samples := []metrics.Sample{
+		{Name: "/gc/heap/live:bytes"},
+		{Name: "/gc/cycles/total:gc-cycles"},
+	}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() != metrics.KindUint64 {
+		return // not supported by this runtime
+	}
+	live, cycle := int64(samples[0].Value.Uint64()), samples[1].Value.Uint64()
+	excess := live - g.memoryLimit
+	// 淘汰之后要等下一次GC，live heap才会降下来；同一个GC周期里只淘汰一次，避免把缓存清空。
+	if excess <= 0 || atomic.SwapUint64(&g.memoryGC, cycle) == cycle {
+		return
+	}
+
+	evicted := g.hotCache.shrinkBy(excess)
+	if hot := g.hotCache.Bytes(); excess > hot {
+		evicted += g.mainCache.shrinkBy(excess - hot)
+	}
+	g.Stats.MemoryEvictions.Add(int64(evicted))
+}
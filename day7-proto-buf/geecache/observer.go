@@ -0,0 +1,61 @@
+package geecache
+
+// Observer把Get过程里的各个事件暴露出来，指标、追踪、审计日志都可以挂在上面，不用改Group.Get/load/getLocally。
+
+import (
+	"fmt"
+	"time"
+)
+
+// An Observer is told about what a Group does while serving Gets. Its
+// methods are called synchronously on the request path, from many
+// goroutines at once, so they must be fast and safe for concurrent use.
+// Embed NopObserver to implement only some of them.
+type Observer interface {
+	// Hit is called when key was found in the group's caches.
+	Hit(group, key string)
+	// Miss is called when key has to be loaded.
+	Miss(group, key string)
+	// PeerLoad is called when peer returned key, after latency.
+	PeerLoad(group, key, peer string, latency time.Duration)
+	// PeerError is called when asking peer for key failed.
+	PeerError(group, key, peer string, err error)
+	// LocalLoad is called when the getter loaded key, after latency.
+	LocalLoad(group, key string, latency time.Duration)
+	// LoadError is called when the getter failed to load key.
+	LoadError(group, key string, err error)
+	// Dedup is called when a Get waited for another Get of the same key
+	// to load it instead of loading it again.
+	Dedup(group, key string)
+	// Evict is called when key left the group's caches.
+	Evict(group, key string, reason EvictionReason)
+}
+
+// NopObserver is an Observer that does nothing.
+type NopObserver struct{}
+
+func (NopObserver) Hit(group, key string)                                   {}
+func (NopObserver) Miss(group, key string)                                  {}
+func (NopObserver) PeerLoad(group, key, peer string, latency time.Duration) {}
+func (NopObserver) PeerError(group, key, peer string, err error)            {}
+func (NopObserver) LocalLoad(group, key string, latency time.Duration)      {}
+func (NopObserver) LoadError(group, key string, err error)                  {}
+func (NopObserver) Dedup(group, key string)                                 {}
+func (NopObserver) Evict(group, key string, reason EvictionReason)          {}
+
+// WithObserver registers o with the group. It may be given more than
+// once; observers are called in the order they were registered.
+func WithObserver(o Observer) GroupOption {
+	return func(g *Group) {
+		g.observers = append(g.observers, o)
+	}
+}
+
+// peerName names peer for observers: its String method if it has one,
+// e.g. the base URL of an HTTPPool peer.
+func peerName(peer PeerGetter) string {
+	if s, ok := peer.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", peer)
+}
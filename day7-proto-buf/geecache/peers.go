@@ -1,6 +1,9 @@
 package geecache
 
-import pb "geecache/geecachepb"
+import (
+	"context"
+	pb "geecache/geecachepb"
+)
 
 // PeerPicker is the interface that must be implemented to locate
 // the peer that owns a specific key.
@@ -12,3 +15,11 @@ type PeerPicker interface {
 type PeerGetter interface {
 	Get(in *pb.Request, out *pb.Response) error
 }
+
+// A ContextPeerGetter is a PeerGetter that also takes the context of the
+// request, e.g. to carry its trace to the peer. Groups use GetContext
+// when a peer implements it.
+type ContextPeerGetter interface {
+	PeerGetter
+	GetContext(ctx context.Context, in *pb.Request, out *pb.Response) error
+}
@@ -16,7 +16,8 @@ type Group struct {
 // Do 的作用就是，针对相同的 key，无论 Do 被调用多少次，函数 fn 都只会被调用一次，等待 fn 调用结束了，返回返回值或错误。
 // Do 的fn包裹了一次httpGet请求。
 // 现在考虑：多线程同时通过同一g实例，调用Do方法
-func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+// shared为true说明这次调用没有执行fn，而是等到了别人的结果。
+func (g *Group) Do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
 
 	g.mu.Lock() // 某一个Do使用了g.mu.Lock()之后，下一个要使用Do，也要调用g.mu.Lock()，由于第一个Do已经调用了Lock()，所以第二个Lock()的调用将会被阻塞。
 
@@ -27,7 +28,7 @@ func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, err
 	if c, ok := g.m[key]; ok { // 如果有key了
 		g.mu.Unlock()
 		c.wg.Wait()
-		return c.val, c.err
+		return c.val, c.err, true
 	}
 
 	c := new(call) // 所有的重复请求共享同一个call实例
@@ -42,5 +43,5 @@ func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, err
 	delete(g.m, key)
 	g.mu.Unlock()
 
-	return c.val, c.err
+	return c.val, c.err, false
 }
@@ -0,0 +1,145 @@
+package geecache
+
+// Sink是调用方提供的"目的地"：getter和Group.GetInto直接把结果填进去，
+// 不用先返回一个新分配的[]byte再由调用方拷贝、解码一遍。
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// A Sink receives the value of a Get call.
+//
+// A SinkGetter must call exactly one of the Set methods on success.
+type Sink interface {
+	// SetString sets the value to s.
+	SetString(s string) error
+
+	// SetBytes sets the value to a copy of b; the caller keeps b.
+	SetBytes(b []byte) error
+
+	// SetProto sets the value to the encoding of m; the caller keeps m.
+	SetProto(m proto.Message) error
+
+	// setView sets the value to v without copying it.
+	setView(v ByteView) error
+
+	// view returns the value last set, for caching.
+	view() ByteView
+}
+
+// A SinkGetter is a Getter that can fill a Sink directly, e.g. with
+// SetString or SetProto, sparing a copy of the value. ctx is the context
+// of the Get call that made the group load the key.
+type SinkGetter interface {
+	Getter
+	GetSink(ctx context.Context, key string, dest Sink) error
+}
+
+// A SinkGetterFunc implements SinkGetter with a function.
+type SinkGetterFunc func(ctx context.Context, key string, dest Sink) error
+
+// GetSink implements SinkGetter.
+func (f SinkGetterFunc) GetSink(ctx context.Context, key string, dest Sink) error {
+	return f(ctx, key, dest)
+}
+
+// Get implements Getter.
+func (f SinkGetterFunc) Get(key string) ([]byte, error) {
+	var v ByteView
+	if err := f(context.Background(), key, ByteViewSink(&v)); err != nil {
+		return nil, err
+	}
+	return v.ByteSlice(), nil
+}
+
+// sink implements Sink on top of a ByteView: every Set method turns its
+// argument into a ByteView and hands it to fill, which writes it to the
+// caller's destination. ByteView是不可变的，所以缓存和fill可以共用同一份数据。
+type sink struct {
+	v    ByteView
+	fill func(v ByteView) error
+}
+
+func (s *sink) SetString(str string) error {
+	return s.setView(ByteView{s: str})
+}
+
+func (s *sink) SetBytes(b []byte) error {
+	return s.setView(ByteView{b: cloneBytes(b)})
+}
+
+func (s *sink) SetProto(m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.setView(ByteView{b: b})
+}
+
+func (s *sink) setView(v ByteView) error {
+	if err := s.fill(v); err != nil {
+		return err
+	}
+	s.v = v
+	return nil
+}
+
+func (s *sink) view() ByteView {
+	return s.v
+}
+
+// StringSink returns a Sink that stores the value in *sp.
+func StringSink(sp *string) Sink {
+	return &sink{fill: func(v ByteView) error {
+		*sp = v.String()
+		return nil
+	}}
+}
+
+// ByteViewSink returns a Sink that stores the value in *dst, sharing the
+// cached bytes instead of copying them.
+func ByteViewSink(dst *ByteView) Sink {
+	if dst == nil {
+		panic("nil dst")
+	}
+	return &sink{fill: func(v ByteView) error {
+		*dst = v
+		return nil
+	}}
+}
+
+// ProtoSink returns a Sink that unmarshals the value into m.
+func ProtoSink(m proto.Message) Sink {
+	return &sink{fill: func(v ByteView) error {
+		// proto.Unmarshal不会保留传进去的切片，直接用v的底层数据就行。
+		return proto.Unmarshal(v.bytes(), m)
+	}}
+}
+
+// AllocatingByteSliceSink returns a Sink that stores a newly allocated
+// copy of the value in *dst. The copy is not retained by geecache.
+func AllocatingByteSliceSink(dst *[]byte) Sink {
+	return &sink{fill: func(v ByteView) error {
+		if dst == nil {
+			return errors.New("nil AllocatingByteSliceSink *[]byte dst")
+		}
+		*dst = v.ByteSlice()
+		return nil
+	}}
+}
+
+// TruncatingByteSliceSink returns a Sink that copies up to len(*dst)
+// bytes of the value into *dst, silently dropping the rest. If the value
+// is shorter, *dst is shrunk to its length.
+func TruncatingByteSliceSink(dst *[]byte) Sink {
+	return &sink{fill: func(v ByteView) error {
+		if dst == nil {
+			return errors.New("nil TruncatingByteSliceSink *[]byte dst")
+		}
+		*dst = (*dst)[:v.Copy(*dst)]
+		return nil
+	}}
+}
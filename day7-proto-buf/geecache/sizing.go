@@ -0,0 +1,129 @@
+package geecache
+
+// NewGroup的cacheBytes是固定的：配小了浪费内存，配大了进程别处一涨就可能被OOM kill。
+// SizeController定期对照一个进程级的软上限（或者debug.SetMemoryLimit）看内存用量，
+// 压力大时按比例缩小每个group的预算（lru.Resize会立刻淘汰到新预算以内），压力小时慢慢放大，
+// 但始终在group的floor和ceiling之间。
+
+import (
+	"context"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"time"
+)
+
+const (
+	// Above highWater of the limit the controller shrinks budgets, below
+	// lowWater it grows them; in between it leaves them alone.
+	highWater = 0.9
+	lowWater  = 0.7
+	// growStep is how much a budget grows per adjustment.
+	growStep = 0.1
+)
+
+// WithAdaptiveSize lets a SizeController resize the group's caches
+// between floor and ceiling bytes, starting from the budget the group has
+// once all its options are applied, e.g. that of WithMemoryLimit.
+func WithAdaptiveSize(floor, ceiling int64) GroupOption {
+	return func(g *Group) {
+		g.sizeFloor, g.sizeCeiling = floor, ceiling
+	}
+}
+
+// CacheBytes returns the current budget of the group's caches, which
+// changes over time for groups created WithAdaptiveSize.
+func (g *Group) CacheBytes() int64 {
+	return g.mainCache.size() + g.hotCache.size()
+}
+
+// resize sets the budget of the group's caches, hotCache getting an
+// eighth of it as in NewGroup.
+func (g *Group) resize(cacheBytes int64) {
+	g.hotCache.Resize(cacheBytes / 8)
+	g.mainCache.Resize(cacheBytes - cacheBytes/8)
+}
+
+// A SizeController resizes the groups created WithAdaptiveSize according
+// to how close the process is to its memory limit.
+type SizeController struct {
+	softLimit int64
+	interval  time.Duration
+
+	// memoryUsed reports the memory used by the process; replaced in tests.
+	memoryUsed func() int64
+}
+
+// NewSizeController returns a controller that keeps the memory used by the
+// process under softLimit bytes, checking every interval. If softLimit is
+// 0, the limit set with debug.SetMemoryLimit is used.
+func NewSizeController(softLimit int64, interval time.Duration) *SizeController {
+	return &SizeController{softLimit: softLimit, interval: interval, memoryUsed: memoryUsed}
+}
+
+// Run adjusts the groups every interval until ctx is done.
+func (c *SizeController) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Adjust()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *SizeController) limit() int64 {
+	if c.softLimit > 0 {
+		return c.softLimit
+	}
+	return debug.SetMemoryLimit(-1) // 负数只读不改
+}
+
+// Adjust resizes every adaptive group once: by the factor that brings the
+// memory used back under the low water mark when it is above the high
+// water mark, or up by 10% when it is below the low water mark.
+func (c *SizeController) Adjust() {
+	limit := c.limit()
+	if limit <= 0 || limit == math.MaxInt64 {
+		return // 没有上限，无从调节
+	}
+	used := c.memoryUsed()
+
+	var scale float64
+	switch {
+	case float64(used) > highWater*float64(limit):
+		scale = lowWater * float64(limit) / float64(used)
+	case float64(used) < lowWater*float64(limit):
+		scale = 1 + growStep
+	default:
+		return
+	}
+
+	mu.RLock()
+	var adaptive []*Group
+	for _, g := range groups {
+		if g.sizeCeiling > 0 {
+			adaptive = append(adaptive, g)
+		}
+	}
+	mu.RUnlock()
+
+	for _, g := range adaptive {
+		size := int64(float64(g.CacheBytes()) * scale)
+		g.resize(min(max(size, g.sizeFloor), g.sizeCeiling))
+	}
+}
+
+// memoryUsed returns the memory the Go runtime holds from the OS, which is
+// what debug.SetMemoryLimit limits.
+func memoryUsed() int64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return int64(samples[0].Value.Uint64() - samples[1].Value.Uint64())
+}
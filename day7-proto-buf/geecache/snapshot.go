@@ -0,0 +1,309 @@
+package geecache
+
+// 重启之后缓存是空的，所有请求都会打到slow DB上。snapshot把mainCache定期写到磁盘，重启时再读回来。
+//
+// 文件格式（所有整数都是varint，除非特别说明）：
+//
+//	magic "GEES" | version uint16 big endian | len(codec) codec
+//	{ 1 | len(key) key | len(value) value | expiry unix nano, 0 = never } ...
+//	0 | crc32 (IEEE) of everything before it, uint32 big endian
+//
+// codec是group的compress.Codec的名字，value都是用它编码后的形式。version 1没有codec，相当于"none"。
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"geecache/compress"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	snapshotMagic   = "GEES"
+	snapshotVersion = 2
+
+	snapshotEntry = 1
+	snapshotEnd   = 0
+
+	// maxSnapshotRecord bounds the keys and values of a snapshot for groups
+	// without a max value size.
+	maxSnapshotRecord = 1 << 30
+	// snapshotReadChunk is how much of a record is allocated before its
+	// bytes have actually been read.
+	snapshotReadChunk = 64 << 10
+)
+
+// WithSnapshotDir makes the group restore mainCache from a snapshot in dir
+// when it is created, and write a new snapshot there every interval until
+// StopSnapshots is called. Peers are not registered yet when the snapshot
+// is restored: the restored keys owned by another peer are dropped by
+// RegisterPeers.
+func WithSnapshotDir(dir string, interval time.Duration) GroupOption {
+	return func(g *Group) {
+		g.snapshotDir = dir
+		g.snapshotInterval = interval
+	}
+}
+
+// Snapshot writes the contents of mainCache to w, from the least to the
+// most recently used entry.
+func (g *Group) Snapshot(w io.Writer) error {
+	h := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+
+	var buf [binary.MaxVarintLen64]byte
+	writeUvarint := func(x uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf[:], x)])
+	}
+
+	bw.WriteString(snapshotMagic)
+	binary.Write(bw, binary.BigEndian, uint16(snapshotVersion))
+	writeUvarint(uint64(len(g.codec.Name())))
+	bw.WriteString(g.codec.Name())
+	for _, key := range g.mainCache.Keys() {
+		v, expires, ok := g.mainCache.peek(key)
+		if !ok {
+			continue // evicted or expired since Keys was called
+		}
+		bw.WriteByte(snapshotEntry)
+		writeUvarint(uint64(len(key)))
+		bw.WriteString(key)
+		writeUvarint(uint64(v.Len()))
+		v.WriteTo(bw)
+		bw.Write(buf[:binary.PutVarint(buf[:], expires)])
+	}
+	bw.WriteByte(snapshotEnd)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, h.Sum32())
+}
+
+type snapshotRecord struct {
+	key    string
+	value  []byte
+	expiry int64
+}
+
+// Restore loads a snapshot written by Snapshot into mainCache. Nothing is
+// loaded unless the whole snapshot is valid. Expired entries and keys
+// owned by another peer are skipped.
+func (g *Group) Restore(r io.Reader) error {
+	br := &hashReader{r: bufio.NewReader(r), h: crc32.NewIEEE()}
+
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return fmt.Errorf("geecache: reading snapshot header: %v", err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return errors.New("geecache: not a snapshot")
+	}
+	// 校验和要读完才能验证，在那之前记录的长度都不可信。
+	limit := int64(maxSnapshotRecord)
+	if g.maxValueSize > 0 {
+		limit = wireLimit(g.maxValueSize)
+	}
+
+	var codec string
+	switch v := binary.BigEndian.Uint16(header[len(snapshotMagic):]); v {
+	case 1:
+	case snapshotVersion:
+		name, err := readSnapshotBytes(br, limit)
+		if err != nil {
+			return err
+		}
+		codec = string(name)
+	default:
+		return fmt.Errorf("geecache: unsupported snapshot version %d", v)
+	}
+
+	var records []snapshotRecord
+	for {
+		tag, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("geecache: reading snapshot: %v", err)
+		}
+		if tag == snapshotEnd {
+			break
+		}
+		if tag != snapshotEntry {
+			return fmt.Errorf("geecache: bad snapshot record %d", tag)
+		}
+
+		key, err := readSnapshotBytes(br, limit)
+		if err != nil {
+			return err
+		}
+		value, err := readSnapshotBytes(br, limit)
+		if err != nil {
+			return err
+		}
+		expiry, err := binary.ReadVarint(br)
+		if err != nil {
+			return fmt.Errorf("geecache: reading snapshot: %v", err)
+		}
+		records = append(records, snapshotRecord{string(key), value, expiry})
+	}
+
+	// 校验和本身不参与计算，所以绕过hashReader直接读后面4个字节。
+	sum := br.h.Sum32()
+	var want uint32
+	if err := binary.Read(br.r, binary.BigEndian, &want); err != nil {
+		return fmt.Errorf("geecache: reading snapshot checksum: %v", err)
+	}
+	if sum != want {
+		return errors.New("geecache: snapshot checksum mismatch")
+	}
+
+	if _, ok := compress.Lookup(codec); !ok {
+		return fmt.Errorf("geecache: snapshot uses unknown codec %q", codec)
+	}
+
+	now := time.Now().UnixNano()
+	for _, rec := range records {
+		if rec.expiry != 0 && rec.expiry <= now {
+			continue
+		}
+		if !g.owns(rec.key) {
+			continue
+		}
+		v, err := g.transcode(rec.key, rec.value, codec)
+		if err != nil {
+			g.logger.Warn("restoring snapshot entry failed", keyAttr(rec.key), "error", err)
+			continue
+		}
+		g.mainCache.addExpiring(rec.key, v, rec.expiry)
+	}
+	if g.memoryLimit > 0 {
+		g.checkMemory()
+	}
+	return nil
+}
+
+// hashReader feeds the bytes it reads, and only those, to h.
+type hashReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+}
+
+func (r *hashReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	return n, err
+}
+
+func (r *hashReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+// readSnapshotBytes reads a length-prefixed string of at most limit bytes.
+// The buffer grows as the bytes arrive, so a corrupted length costs no
+// more memory than the snapshot really has.
+func readSnapshotBytes(br *hashReader, limit int64) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("geecache: reading snapshot: %v", err)
+	}
+	if n > uint64(limit) {
+		return nil, fmt.Errorf("geecache: snapshot record too large: %d bytes", n)
+	}
+	var b bytes.Buffer
+	b.Grow(int(min(n, snapshotReadChunk)))
+	if _, err := io.CopyN(&b, br, int64(n)); err != nil {
+		return nil, fmt.Errorf("geecache: reading snapshot: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+func (g *Group) snapshotPath() string {
+	return filepath.Join(g.snapshotDir, url.PathEscape(g.name)+".snapshot")
+}
+
+// startSnapshots restores the last snapshot, if any, and starts writing
+// new ones every snapshotInterval.
+func (g *Group) startSnapshots() {
+	if f, err := os.Open(g.snapshotPath()); err == nil {
+		if err := g.Restore(f); err != nil {
+			g.logger.Error("restoring snapshot failed", "file", f.Name(), "error", err)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		g.logger.Error("restoring snapshot failed", "error", err)
+	}
+
+	if g.snapshotInterval <= 0 {
+		return
+	}
+	g.snapshotStop = make(chan struct{})
+	g.snapshotDone = make(chan struct{})
+	go func() {
+		defer close(g.snapshotDone)
+		ticker := time.NewTicker(g.snapshotInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := g.writeSnapshot(); err != nil {
+					g.logger.Error("writing snapshot failed", "error", err)
+				}
+			case <-g.snapshotStop:
+				return
+			}
+		}
+	}()
+}
+
+// StopSnapshots stops the periodic snapshots started by WithSnapshotDir
+// and writes a last one, e.g. before the process exits. Later calls, and
+// calls on groups without periodic snapshots, do nothing.
+func (g *Group) StopSnapshots() error {
+	if g.snapshotStop == nil {
+		return nil
+	}
+	stopped := false
+	g.snapshotOnce.Do(func() {
+		close(g.snapshotStop)
+		<-g.snapshotDone // 等正在写的snapshot写完，免得和下面这次抢同一个文件
+		stopped = true
+	})
+	if !stopped {
+		return nil
+	}
+	return g.writeSnapshot()
+}
+
+// writeSnapshot writes a snapshot to a temporary file and renames it into
+// place, so a crash never leaves a half-written snapshot behind.
+func (g *Group) writeSnapshot() error {
+	f, err := os.CreateTemp(g.snapshotDir, url.PathEscape(g.name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+
+	if err := g.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), g.snapshotPath())
+}
@@ -0,0 +1,264 @@
+package geecache
+
+// 几MB的大value：httpGetter.Get要io.ReadAll一遍、proto.Unmarshal再拷贝一遍，ServeHTTP也要proto.Marshal拷贝一遍。
+// 超过阈值的value改成分块传输：ServeHTTP直接把value一块一块写出去，httpGetter按value的大小一次分配好内存，边读边填。
+//
+// 分块传输省掉的是这些额外的拷贝，不是value本身：缓存里存的是完整的ByteView，所以两端仍然各要在内存里放一份
+// 完整的value（客户端最多再多一个chunk）。真正限制内存的是WithMaxValueSize。
+//
+// 分块格式：{ len(chunk) uvarint | chunk } ... | 0
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const (
+	// acceptStreamHeader is set by clients that can read streamed values.
+	acceptStreamHeader = "X-Geecache-Accept-Stream"
+	streamContentType  = "application/x-geecache-stream"
+	codecHeader        = "X-Geecache-Codec"      // codec of a streamed value
+	valueSizeHeader    = "X-Geecache-Value-Size" // size of a streamed value
+	// maxValueSizeHeader carries the limit a value exceeded, along with
+	// http.StatusRequestEntityTooLarge.
+	maxValueSizeHeader = "X-Geecache-Max-Value-Size"
+
+	defaultStreamThreshold = 1 << 20
+	streamChunkSize        = 64 << 10
+	// maxStreamChunk guards against allocating huge buffers for a
+	// corrupted chunk length.
+	maxStreamChunk = 16 << 20
+)
+
+// A ValueTooLargeError is returned for values larger than the max value
+// size of their group, see WithMaxValueSize.
+type ValueTooLargeError struct {
+	Group string
+	Key   string
+	Limit int64
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("geecache: value of %q in group %s is larger than %d bytes", e.Key, e.Group, e.Limit)
+}
+
+// WithMaxValueSize makes the group refuse values larger than n bytes with
+// a *ValueTooLargeError, both when the getter loads them and when a peer
+// would send them. Peers are told the limit and enforce it on their end
+// too, so a value that is too large is never transferred. The limit is on
+// values as the getter returns them, before WithCompression encodes them.
+func WithMaxValueSize(n int64) GroupOption {
+	return func(g *Group) {
+		g.maxValueSize = n
+	}
+}
+
+// WithStreamThreshold makes the pool stream values of at least n bytes to
+// the peers that support it instead of sending them in one protobuf
+// message. The default is 1MB; n <= 0 turns streaming off.
+//
+// Streaming spares the copies that marshalling and unmarshalling a whole
+// message make, but not the value itself: values are cached whole, so
+// each end still holds all of it in memory. Use WithMaxValueSize to bound
+// that.
+func WithStreamThreshold(n int) PoolOption {
+	return func(p *HTTPPool) {
+		p.streamThreshold = n
+	}
+}
+
+// A ReaderGetter is a Getter that can also stream the value of a key. The
+// group reads the value into its cache, which holds it whole, and stops
+// reading as soon as it exceeds the max value size.
+type ReaderGetter interface {
+	Getter
+	GetReader(key string) (io.ReadCloser, error)
+}
+
+// A ReaderGetterFunc implements ReaderGetter with a function.
+type ReaderGetterFunc func(key string) (io.ReadCloser, error)
+
+// GetReader implements ReaderGetter.
+func (f ReaderGetterFunc) GetReader(key string) (io.ReadCloser, error) {
+	return f(key)
+}
+
+// Get implements Getter.
+func (f ReaderGetterFunc) Get(key string) ([]byte, error) {
+	rc, err := f(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (g *Group) tooLarge(key string) error {
+	return &ValueTooLargeError{Group: g.name, Key: key, Limit: g.maxValueSize}
+}
+
+// getterValue loads the value of key with the getter and, if dest is not
+// nil, fills dest with it.
+func (g *Group) getterValue(ctx context.Context, key string, dest Sink) (ByteView, error) {
+	if sg, ok := g.getter.(SinkGetter); ok {
+		var v ByteView
+		if dest == nil {
+			dest = ByteViewSink(&v)
+		}
+		// 先检查大小再填dest，太大的value不能先交给调用方再报错。
+		var tooLarge bool
+		if g.maxValueSize > 0 {
+			caller := dest
+			dest = &sink{fill: func(v ByteView) error {
+				if int64(v.Len()) > g.maxValueSize {
+					tooLarge = true
+					return g.tooLarge(key)
+				}
+				return caller.setView(v)
+			}}
+		}
+		err := sg.GetSink(ctx, key, dest)
+		if tooLarge {
+			return ByteView{}, g.tooLarge(key) // 即使getter吞掉了Set返回的错误
+		}
+		if err != nil {
+			return ByteView{}, err
+		}
+		return dest.view(), nil
+	}
+
+	var b []byte
+	if rg, ok := g.getter.(ReaderGetter); ok {
+		rc, err := rg.GetReader(key)
+		if err != nil {
+			return ByteView{}, err
+		}
+		defer rc.Close()
+		r := io.Reader(rc)
+		if g.maxValueSize > 0 {
+			r = io.LimitReader(rc, g.maxValueSize+1)
+		}
+		if b, err = io.ReadAll(r); err != nil {
+			return ByteView{}, err
+		}
+	} else {
+		got, err := g.getter.Get(key)
+		if err != nil {
+			return ByteView{}, err
+		}
+		b = cloneBytes(got)
+	}
+	if g.maxValueSize > 0 && int64(len(b)) > g.maxValueSize {
+		return ByteView{}, g.tooLarge(key)
+	}
+
+	v := ByteView{b: b}
+	if dest != nil {
+		if err := dest.setView(v); err != nil {
+			return ByteView{}, err
+		}
+	}
+	return v, nil
+}
+
+// valueLimit returns the smallest of the group's max value size and limit,
+// ignoring the ones that are not positive.
+func (g *Group) valueLimit(limit int64) int64 {
+	if limit <= 0 || (g.maxValueSize > 0 && g.maxValueSize < limit) {
+		return g.maxValueSize
+	}
+	return limit
+}
+
+// wireLimit bounds the encoded size of a value of at most limit bytes:
+// codecs make incompressible values slightly larger.
+func wireLimit(limit int64) int64 {
+	if limit <= 0 {
+		return limit
+	}
+	return limit + limit/64 + 64
+}
+
+// writeTooLarge reports a value exceeding limit to the client.
+func writeTooLarge(w http.ResponseWriter, err *ValueTooLargeError) {
+	w.Header().Set(maxValueSizeHeader, strconv.FormatInt(err.Limit, 10))
+	http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+}
+
+// writeStream sends value, encoded with codec, in chunks.
+func writeStream(w http.ResponseWriter, value []byte, codec string) {
+	w.Header().Set("Content-Type", streamContentType)
+	w.Header().Set(codecHeader, codec)
+	w.Header().Set(valueSizeHeader, strconv.Itoa(len(value)))
+
+	var buf [binary.MaxVarintLen64]byte
+	for len(value) > 0 {
+		n := min(len(value), streamChunkSize)
+		if _, err := w.Write(buf[:binary.PutUvarint(buf[:], uint64(n))]); err != nil {
+			return
+		}
+		if _, err := w.Write(value[:n]); err != nil {
+			return
+		}
+		value = value[n:]
+	}
+	w.Write(buf[:binary.PutUvarint(buf[:], 0)])
+}
+
+// errTruncatedStream is returned for streams that end without their last chunk.
+var errTruncatedStream = errors.New("geecache: truncated value stream")
+
+// readStream reads a value sent by writeStream. size is the size announced
+// by the server, or -1. limit, if positive, is the largest value to accept.
+func readStream(r io.Reader, size, limit int64) ([]byte, error) {
+	if limit > 0 && size > limit {
+		return nil, errTooLarge
+	}
+	var buf []byte
+	if size > 0 {
+		buf = make([]byte, 0, min(size, maxStreamChunk)) // 不完全相信对方报的大小
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			if err == io.EOF {
+				err = errTruncatedStream
+			}
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		if n > maxStreamChunk {
+			return nil, fmt.Errorf("geecache: value stream chunk too large: %d bytes", n)
+		}
+		if limit > 0 && int64(len(buf))+int64(n) > limit {
+			return nil, errTooLarge
+		}
+		start := len(buf)
+		buf = slices.Grow(buf, int(n))[:start+int(n)]
+		if _, err := io.ReadFull(br, buf[start:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errTruncatedStream
+			}
+			return nil, err
+		}
+	}
+	if size >= 0 && int64(len(buf)) != size {
+		return nil, fmt.Errorf("geecache: value stream has %d bytes, want %d", len(buf), size)
+	}
+	return buf, nil
+}
+
+// errTooLarge is returned by readStream; httpGetter turns it into a
+// *ValueTooLargeError for the key it asked for.
+var errTooLarge = errors.New("geecache: value too large")
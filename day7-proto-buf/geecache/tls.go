@@ -0,0 +1,185 @@
+package geecache
+
+// peer之间默认是明文HTTP。WithServerTLS/WithClientTLS让HTTPPool用https对外服务、用https访问其他peer；
+// 两边都校验对方证书就是mTLS。CertReloader在证书文件被替换之后自动换上新证书，不需要重启。
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// WithServerTLS makes ListenAndServe and Serve serve the pool over TLS
+// with config. Set config.ClientAuth to tls.RequireAndVerifyClientCert and
+// config.ClientCAs to only accept peers presenting a trusted certificate.
+func WithServerTLS(config *tls.Config) PoolOption {
+	return func(p *HTTPPool) {
+		p.serverTLS = config
+	}
+}
+
+// WithClientTLS makes the pool dial https peers with config, e.g. to trust
+// a private CA or present a client certificate for mutual TLS.
+func WithClientTLS(config *tls.Config) PoolOption {
+	return func(p *HTTPPool) {
+		p.client = &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   config,
+			ForceAttemptHTTP2: true,
+		}}
+	}
+}
+
+// httpClient returns the client used to talk to other peers.
+func (p *HTTPPool) httpClient() *http.Client {
+	if p == nil || p.client == nil {
+		return http.DefaultClient
+	}
+	return p.client
+}
+
+// ListenAndServe serves the pool on the host and port of its own base URL,
+// over TLS if the URL is https.
+func (p *HTTPPool) ListenAndServe() error {
+	u, err := url.Parse(p.self)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return err
+	}
+	return p.Serve(l)
+}
+
+// Serve serves the pool on l, over TLS if the pool's base URL is https.
+func (p *HTTPPool) Serve(l net.Listener) error {
+	u, err := url.Parse(p.self)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	srv := &http.Server{Handler: p, TLSConfig: p.serverTLS}
+	switch {
+	case u.Scheme == "https" && p.serverTLS == nil:
+		l.Close()
+		return errors.New("geecache: https peer without WithServerTLS")
+	case u.Scheme == "https":
+		return srv.ServeTLS(l, "", "")
+	default:
+		return srv.Serve(l)
+	}
+}
+
+// A CertReloader serves a certificate and key from files and picks up new
+// versions of the files when they change, so certificates can be rotated
+// without restarting. Use ServerConfig and ClientConfig to build tls.Configs
+// for WithServerTLS and WithClientTLS.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of the two files when cert was loaded
+}
+
+// NewCertReloader loads the PEM encoded certificate and key in certFile
+// and keyFile.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key files again.
+func (r *CertReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reload()
+}
+
+// reload loads the files if they changed since they were last loaded. r.mu must be held.
+func (r *CertReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("geecache: loading certificate: %v", err)
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// certificate returns the current certificate, reloading it first if the
+// files changed. A certificate that fails to load, e.g. because only one
+// of the two files was replaced so far, keeps the previous one in use.
+func (r *CertReloader) certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reload()
+	return r.cert
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+// ServerConfig returns a server config presenting r's certificate. If
+// clientCAs is not nil, peers must present a certificate signed by one of
+// them (mutual TLS).
+func (r *CertReloader) ServerConfig(clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+// ClientConfig returns a client config presenting r's certificate to
+// peers that ask for one, and trusting rootCAs, or the system roots if
+// rootCAs is nil.
+func (r *CertReloader) ClientConfig(rootCAs *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		RootCAs:              rootCAs,
+		GetClientCertificate: r.GetClientCertificate,
+	}
+}
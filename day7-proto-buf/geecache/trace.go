@@ -0,0 +1,36 @@
+package geecache
+
+// 一个Get慢了，时间可能花在owner peer上、singleflight的等待上，也可能花在slow DB上。
+// Get、load、getFromPeer、getLocally和ServeHTTP各开一个span，peer之间通过traceparent头把trace串起来。
+
+import (
+	"context"
+	"geecache/tracing"
+)
+
+// WithTracer makes the group record spans for Get and the loads it
+// makes with t. No spans are recorded by default.
+func WithTracer(t *tracing.Tracer) GroupOption {
+	return func(g *Group) {
+		g.tracer = t
+	}
+}
+
+// WithPoolTracer makes the pool record a span with t for every request
+// it serves, joining the trace of the peer that sent it.
+func WithPoolTracer(t *tracing.Tracer) PoolOption {
+	return func(p *HTTPPool) {
+		p.tracer = t
+	}
+}
+
+// startSpan starts a span about key of the group.
+func (g *Group) startSpan(ctx context.Context, name, key string) (context.Context, *tracing.Span) {
+	ctx, span := g.tracer.Start(ctx, name)
+	if span == nil {
+		return ctx, nil // 没配tracer时不用算key的hash
+	}
+	span.SetAttr("group", g.name)
+	span.SetAttr("key_hash", keyHash(key))
+	return ctx, span
+}
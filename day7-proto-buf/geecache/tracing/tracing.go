@@ -0,0 +1,289 @@
+// Package tracing records spans of work done for a request, so that a slow
+// Get can be broken down into the time spent at the owner peer, waiting on
+// another load of the same key, or in the getter. Spans started from a
+// context carrying a span become its children; across processes the trace
+// context travels in W3C traceparent headers, see Inject and Extract.
+//
+// Finished spans are handed to an Exporter, e.g. an adapter to an
+// OpenTelemetry collector or the InMemoryExporter used by tests.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the W3C Trace Context header.
+const TraceparentHeader = "Traceparent"
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id is not all zeros.
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether id is not all zeros.
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// SpanContext is what identifies a span to its children, including those
+// in other processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool // spans of unsampled traces are not exported
+}
+
+// IsValid reports whether sc has a trace and a span ID.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats sc as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value,
+// version-traceid-parentid-flags, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	// 以后的版本可能在后面追加字段，只要前面的格式不变就照样解析。
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || (len(s) > 55 && s[55] != '-') {
+		return sc, errors.New("tracing: malformed traceparent")
+	}
+	version, err := hex.DecodeString(s[0:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(s) != 55) {
+		return sc, errors.New("tracing: bad traceparent version")
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(s[3:35])); err != nil {
+		return sc, errors.New("tracing: bad trace ID")
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(s[36:52])); err != nil {
+		return sc, errors.New("tracing: bad parent ID")
+	}
+	flags, err := hex.DecodeString(s[53:55])
+	if err != nil {
+		return sc, errors.New("tracing: bad trace flags")
+	}
+	if !sc.IsValid() {
+		return sc, errors.New("tracing: all-zero trace or parent ID")
+	}
+	sc.Sampled = flags[0]&1 != 0
+	return sc, nil
+}
+
+// SpanData is a finished span, as exported.
+type SpanData struct {
+	Name     string
+	Context  SpanContext
+	ParentID SpanID // zero for the root span of a trace
+	Remote   bool   // the parent span is in another process
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]string
+	Err      error
+}
+
+// Duration returns how long the span took.
+func (d *SpanData) Duration() time.Duration {
+	return d.End.Sub(d.Start)
+}
+
+// An Exporter receives the spans as they end. ExportSpan is called
+// synchronously by Span.End, from many goroutines, so it must be fast and
+// safe for concurrent use; exporters that send spans over the network
+// should batch them in the background.
+type Exporter interface {
+	ExportSpan(s SpanData)
+}
+
+// A Tracer starts spans and exports them to its Exporter. A nil *Tracer
+// is valid and starts no spans.
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer returns a tracer exporting to e.
+func NewTracer(e Exporter) *Tracer {
+	return &Tracer{exporter: e}
+}
+
+// A Span is an operation in progress. A nil *Span is valid and does
+// nothing, which is what a nil Tracer starts.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start starts a span called name, child of the span in ctx or of the
+// remote span put there by Extract, if any, and returns a context
+// carrying the new span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, data: SpanData{Name: name, Start: time.Now()}}
+	if parent := SpanContextFromContext(ctx); parent.IsValid() {
+		s.data.Context.TraceID = parent.TraceID
+		s.data.Context.Sampled = parent.Sampled
+		s.data.ParentID = parent.SpanID
+		_, local := ctx.Value(spanKey{}).(*Span)
+		s.data.Remote = !local
+	} else {
+		for !s.data.Context.TraceID.IsValid() {
+			binary.LittleEndian.PutUint64(s.data.Context.TraceID[:8], rand.Uint64())
+			binary.LittleEndian.PutUint64(s.data.Context.TraceID[8:], rand.Uint64())
+		}
+		s.data.Context.Sampled = true
+	}
+	for !s.data.Context.SpanID.IsValid() {
+		binary.LittleEndian.PutUint64(s.data.Context.SpanID[:], rand.Uint64())
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SpanContext returns the span's identity.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.Context
+}
+
+// SetAttr sets the attribute key of the span to value. It has no effect
+// once the span has ended, since the exporter may hold the attributes.
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	if s.data.Attrs == nil {
+		s.data.Attrs = make(map[string]string)
+	}
+	s.data.Attrs[key] = value
+}
+
+// SetError records that the operation failed with err; a nil err is
+// ignored, and so is any err once the span has ended.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.data.Err = err
+	}
+}
+
+// End ends the span and exports it if its trace is sampled. Only the
+// first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.Context.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(data)
+	}
+}
+
+// SpanContextFromContext returns the context of the span in ctx, or of
+// the remote span put there by Extract, or the zero SpanContext.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if s, ok := ctx.Value(spanKey{}).(*Span); ok {
+		return s.SpanContext()
+	}
+	if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		return sc
+	}
+	return SpanContext{}
+}
+
+// Inject sets the traceparent header of h to the span context in ctx,
+// if any.
+func Inject(ctx context.Context, h http.Header) {
+	if sc := SpanContextFromContext(ctx); sc.IsValid() {
+		h.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+// Extract returns ctx carrying the remote span context in the
+// traceparent header of h, so that the next span started from it joins
+// the caller's trace. A missing or malformed header is ignored.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, err := ParseTraceparent(h.Get(TraceparentHeader))
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// InMemoryExporter keeps the exported spans in memory, for tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// ExportSpan implements Exporter.
+func (e *InMemoryExporter) ExportSpan(s SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+// Spans returns the spans exported so far, in the order they ended.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SpanData(nil), e.spans...)
+}
+
+// Reset forgets the spans exported so far.
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
+
+// ExporterFunc implements Exporter with a function.
+type ExporterFunc func(s SpanData)
+
+// ExportSpan implements Exporter.
+func (f ExporterFunc) ExportSpan(s SpanData) { f(s) }
@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	const s = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Fatalf("parsed %+v", sc)
+	}
+	if got := sc.Traceparent(); got != s {
+		t.Fatalf("Traceparent() = %q, want %q", got, s)
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, err := ParseTraceparent(bad); err == nil {
+			t.Errorf("ParseTraceparent(%q) should fail", bad)
+		}
+	}
+	// Later versions may append fields.
+	if _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Errorf("version 01 with extra fields: %v", err)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	e := &InMemoryExporter{}
+	tr := NewTracer(e)
+
+	ctx, root := tr.Start(context.Background(), "root")
+	_, child := tr.Start(ctx, "child")
+	child.SetAttr("k", "v")
+	child.SetError(errors.New("boom"))
+	child.End()
+	root.End()
+	root.End()
+
+	spans := e.Spans()
+	if len(spans) != 2 || spans[0].Name != "child" || spans[1].Name != "root" {
+		t.Fatalf("exported %+v", spans)
+	}
+	c, r := spans[0], spans[1]
+	if c.Context.TraceID != r.Context.TraceID || c.ParentID != r.Context.SpanID || r.ParentID.IsValid() || c.Remote {
+		t.Fatalf("child %+v is not a child of root %+v", c, r)
+	}
+	if c.Attrs["k"] != "v" || c.Err == nil || c.Duration() < 0 {
+		t.Fatalf("child lost its attributes: %+v", c)
+	}
+
+	// Exported spans don't change afterwards.
+	child.SetAttr("k", "late")
+	child.SetError(errors.New("late"))
+	if c.Attrs["k"] != "v" || c.Err.Error() != "boom" {
+		t.Fatalf("ended span was changed: %+v", c)
+	}
+
+	// A nil tracer starts nil spans, which are safe to use.
+	ctx, s := (*Tracer)(nil).Start(context.Background(), "nothing")
+	s.SetAttr("k", "v")
+	s.End()
+	if SpanContextFromContext(ctx).IsValid() {
+		t.Fatal("nil tracer put a span in the context")
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	e := &InMemoryExporter{}
+	tr := NewTracer(e)
+
+	ctx, client := tr.Start(context.Background(), "client")
+	h := http.Header{}
+	Inject(ctx, h)
+
+	_, server := tr.Start(Extract(context.Background(), h), "server")
+	server.End()
+	client.End()
+
+	spans := e.Spans()
+	if spans[0].Context.TraceID != spans[1].Context.TraceID || spans[0].ParentID != spans[1].Context.SpanID || !spans[0].Remote {
+		t.Fatalf("server span %+v did not join client span %+v", spans[0], spans[1])
+	}
+
+	// Spans of unsampled traces are not exported.
+	e.Reset()
+	h.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, s := tr.Start(Extract(context.Background(), h), "unsampled")
+	s.End()
+	if len(e.Spans()) != 0 {
+		t.Fatal("unsampled span was exported")
+	}
+}
@@ -0,0 +1,210 @@
+package geecache
+
+// 每个用geecache的团队都在Group.Get和GetterFunc外面包一层JSON编解码。TypedGroup把这层做成通用的：
+// loader直接返回T，Get直接拿到T；中间的字节由Codec[T]负责转换。
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"geecache/lru"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// A Codec converts values of type T to bytes and back.
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+// JSONCodec encodes values with encoding/json.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec encodes values with encoding/gob.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// ProtoCodec encodes protobuf messages. T is a generated message pointer
+// type such as *geecachepb.Request.
+type ProtoCodec[T proto.Message] struct{}
+
+func (ProtoCodec[T]) Marshal(v T) ([]byte, error) { return proto.Marshal(v) }
+
+func (ProtoCodec[T]) Unmarshal(data []byte) (T, error) {
+	var zero T
+	v := zero.ProtoReflect().New().Interface().(T)
+	err := proto.Unmarshal(data, v)
+	return v, err
+}
+
+// A TypedGetter loads the value of a key for a TypedGroup.
+type TypedGetter[T any] interface {
+	Get(ctx context.Context, key string) (T, error)
+}
+
+// A TypedGetterFunc implements TypedGetter with a function.
+type TypedGetterFunc[T any] func(ctx context.Context, key string) (T, error)
+
+// Get implements TypedGetter.
+func (f TypedGetterFunc[T]) Get(ctx context.Context, key string) (T, error) {
+	return f(ctx, key)
+}
+
+// A TypedGroupOption configures a TypedGroup. Every GroupOption is one,
+// and applies to the underlying Group.
+type TypedGroupOption interface {
+	applyTyped(o *typedOptions)
+}
+
+type typedOptions struct {
+	group             []GroupOption
+	decodedCacheBytes int64
+}
+
+func (opt GroupOption) applyTyped(o *typedOptions) {
+	o.group = append(o.group, opt)
+}
+
+type decodedCacheOption int64
+
+func (n decodedCacheOption) applyTyped(o *typedOptions) {
+	o.decodedCacheBytes = int64(n)
+}
+
+// WithDecodedCache makes a TypedGroup keep up to maxBytes worth of decoded
+// values in memory next to their bytes, so getting a cached value does not
+// decode it again. An entry counts as the size of its encoded bytes.
+func WithDecodedCache(maxBytes int64) TypedGroupOption {
+	return decodedCacheOption(maxBytes)
+}
+
+// A TypedGroup is a Group whose values are of type T. Values are stored,
+// sent to peers and handed to the other tiers as bytes encoded by codec.
+type TypedGroup[T any] struct {
+	group   *Group
+	codec   Codec[T]
+	decoded *decodedCache[T] // nil unless WithDecodedCache was given
+}
+
+// NewTypedGroup creates a Group named name whose values are loaded by
+// loader and encoded with codec.
+func NewTypedGroup[T any](name string, cacheBytes int64, codec Codec[T], loader TypedGetter[T], opts ...TypedGroupOption) *TypedGroup[T] {
+	if loader == nil {
+		panic("nil TypedGetter")
+	}
+	var o typedOptions
+	for _, opt := range opts {
+		opt.applyTyped(&o)
+	}
+	t := &TypedGroup[T]{codec: codec}
+	if o.decodedCacheBytes > 0 {
+		t.decoded = &decodedCache[T]{lru: lru.NewCache(o.decodedCacheBytes, decodedSize[T], nil)}
+	}
+	t.group = NewGroup(name, cacheBytes, SinkGetterFunc(func(ctx context.Context, key string, dest Sink) error {
+		v, err := loader.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		b, err := codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		view := ByteView{b: b}
+		if t.decoded != nil {
+			t.decoded.add(key, view, v)
+		}
+		return dest.setView(view)
+	}), o.group...)
+	return t
+}
+
+// Group returns the underlying Group, e.g. to register peers.
+func (t *TypedGroup[T]) Group() *Group {
+	return t.group
+}
+
+// Get returns the value of key. Values served from the decoded cache are
+// shared between callers and must not be modified.
+func (t *TypedGroup[T]) Get(ctx context.Context, key string) (T, error) {
+	var view ByteView
+	if err := t.group.GetInto(ctx, key, ByteViewSink(&view)); err != nil {
+		var zero T
+		return zero, err
+	}
+	if t.decoded != nil {
+		if v, ok := t.decoded.get(key, view); ok {
+			return v, nil
+		}
+	}
+
+	v, err := t.codec.Unmarshal(view.bytes())
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	if t.decoded != nil {
+		t.decoded.add(key, view, v)
+	}
+	return v, nil
+}
+
+// decodedCache holds decoded values along with the bytes they were
+// decoded from. An entry is only used while the group still returns the
+// same bytes for its key, so it can never serve a stale value.
+type decodedCache[T any] struct {
+	mu  sync.Mutex
+	lru *lru.Cache[string, decodedEntry[T]]
+}
+
+type decodedEntry[T any] struct {
+	view ByteView
+	v    T
+}
+
+func decodedSize[T any](key string, e decodedEntry[T]) int64 {
+	return int64(len(key)) + int64(e.view.Len())
+}
+
+func (c *decodedCache[T]) get(key string, view ByteView) (v T, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.lru.Get(key)
+	if !ok {
+		return
+	}
+	if !entry.view.Equal(view) { // 同一块内存时比较是O(1)的
+		return
+	}
+	return entry.v, true
+}
+
+func (c *decodedCache[T]) add(key string, view ByteView, v T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Add(key, decodedEntry[T]{view: view, v: v})
+}
@@ -0,0 +1,84 @@
+package geecache
+
+// 机房/可用区感知：每个peer可以带一个zone标签。开启多副本之后，PickPeer优先选择和自己同zone的副本，
+// 跨zone的流量会被统计出来；也可以让每个zone在本地hotCache里保留一份热点key。
+
+// WithZone sets the zone of this node, e.g. "us-east-1a".
+func WithZone(zone string) PoolOption {
+	return func(p *HTTPPool) {
+		p.zone = zone
+	}
+}
+
+// WithReplication makes every key owned by the first n distinct peers
+// clockwise on the ring instead of just one. Lookups go to the owner in
+// the caller's zone when there is one.
+func WithReplication(n int) PoolOption {
+	return func(p *HTTPPool) {
+		if n > 0 {
+			p.replication = n
+		}
+	}
+}
+
+// WithZoneCopies makes groups keep a copy of hot keys fetched from a peer
+// in another zone, so every zone ends up serving its hot keys locally.
+func WithZoneCopies() PoolOption {
+	return func(p *HTTPPool) {
+		p.zoneCopies = true
+	}
+}
+
+// SetZones updates the zone labels of the peers. zones maps a peer's base
+// URL to its zone; peers without a label are treated as zone-less.
+func (p *HTTPPool) SetZones(zones map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.zones = make(map[string]string, len(zones))
+	for peer, zone := range zones {
+		p.zones[peer] = zone
+	}
+	// httpGetter是并发读取的，不能原地修改，重新生成一遍。
+	for peer := range p.httpGetters {
+		p.httpGetters[peer] = p.newGetter(peer)
+	}
+}
+
+// crossZone reports whether peer is known to be in another zone. p.mu must be held.
+func (p *HTTPPool) crossZone(peer string) bool {
+	zone := p.zones[peer]
+	return p.zone != "" && zone != "" && zone != p.zone
+}
+
+// pickReplica chooses which of the owners of a key to ask: ourselves if we
+// are one of them, else an owner in our zone, else the primary owner.
+// p.mu must be held.
+func (p *HTTPPool) pickReplica(owners []string) string {
+	for _, owner := range owners {
+		if owner == p.self {
+			return owner
+		}
+	}
+	if p.zone != "" {
+		for _, owner := range owners {
+			if p.zones[owner] == p.zone {
+				return owner
+			}
+		}
+	}
+	if len(owners) == 0 {
+		return ""
+	}
+	return owners[0]
+}
+
+// A hotCopier is a PeerGetter whose values should also be kept in the
+// group's hotCache, because fetching them again is expensive.
+type hotCopier interface {
+	keepLocalCopy() bool
+}
+
+func (h *httpGetter) keepLocalCopy() bool {
+	return h.crossZone && h.pool != nil && h.pool.zoneCopies
+}
@@ -1,13 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"geecache"
+	"geecache/compress"
+	"geecache/discovery"
+	"geecache/membership"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+var dbMu sync.RWMutex
+
 var db = map[string]string{ //8001 8002 8003的slow DB都是一样的，可以理解为三个cache server的slow DB数据源是一样的。
 	"Tom":  "630",
 	"Jack": "589",
@@ -15,72 +31,267 @@ var db = map[string]string{ //8001 8002 8003的slow DB都是一样的，可以
 } 
 
 // 一个Cache Server就是一个Group。每一个cache server都有一个本地的数据源，如果缓存找不到数据了，就去本地数据源里面找。本地数据源在形式上是一个函数，调用这个函数就能完成本地取数据。
-func createGroup() *geecache.Group {
+func createGroup(opts ...geecache.GroupOption) *geecache.Group {
 	return geecache.NewGroup("scores", 2<<10, geecache.GetterFunc( // 这个GetterFunc是对slow DB的访问
 		func(key string) ([]byte, error) {
 			log.Println("[SlowDB] Search key:", key)
 
+			dbMu.RLock()
+			defer dbMu.RUnlock()
 			if v, ok := db[key]; ok {
 				return []byte(v), nil
 			}
 			return nil, fmt.Errorf("%s not exist", key)
-		}))
+		}), opts...)
 }
 
 // 为新创建的Group添加Peer（http Server），并启动http服务。
-// addrs是包括自己在内的所有cache的ip+port
-func startCacheServer(addr string, addrs []string, gee *geecache.Group) {
-	peers := geecache.NewHTTPPool(addr) // 一般httppool用来handle请求的。
-	peers.Set(addrs...)
+// d提供包括自己在内的所有cache的ip+port，peer集合变化时会自动更新hash环。
+func startCacheServer(addr string, d discovery.Discovery, gee *geecache.Group, opts ...geecache.PoolOption) {
+	peers := geecache.NewHTTPPool(addr, opts...) // 一般httppool用来handle请求的。
+	if err := peers.Watch(context.Background(), d); err != nil {
+		log.Fatal(err)
+	}
 	gee.RegisterPeers(peers)
 	log.Println("geecache is running at", addr)
-	log.Fatal(http.ListenAndServe(addr[7:], peers))
+	log.Fatal(peers.ListenAndServe())
+}
+
+// tlsOptions builds the pool options for serving and dialing peers over
+// mutual TLS with the given certificate, key and CA files.
+func tlsOptions(certFile, keyFile, caFile string) []geecache.PoolOption {
+	certs, err := geecache.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var cas *x509.CertPool
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			log.Fatalf("no certificates in %s", caFile)
+		}
+	}
+	return []geecache.PoolOption{
+		geecache.WithServerTLS(certs.ServerConfig(cas)),
+		geecache.WithClientTLS(certs.ClientConfig(cas)),
+	}
 }
 
 // 在 Go 的 net/http 包中，HTTP 服务器默认会为每个请求启动一个独立的 goroutine（轻量级线程），因此多个请求会并发处理，而不是串行等待前一个请求完成。
-func startApiServer(apiAddr string, gee *geecache.Group) {
+// GET /api?group=scores&key=Tom 读缓存；PUT /api?group=scores&key=Tom 把body写进slow DB（已经缓存的旧值要等淘汰之后才看得到）。
+// tokens不为nil时，请求必须带 Authorization: Bearer <token>，并且token对这个group有相应的权限。
+func startApiServer(apiAddr string, tokens acl) {
 	http.Handle("/api", http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) { // 一般都是接受请求用指针，响应用值类型。
 			key := r.URL.Query().Get("key") // 常见的对请求的前置处理
+			groupName := r.URL.Query().Get("group")
+			if groupName == "" {
+				groupName = "scores"
+			}
+
+			var perm byte
+			switch r.Method {
+			case http.MethodGet:
+				perm = 'r'
+			case http.MethodPut:
+				perm = 'w'
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if !tokens.allows(r, groupName, perm) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
+			gee := geecache.GetGroup(groupName)
+			if gee == nil {
+				http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+				return
+			}
+
+			if r.Method == http.MethodPut {
+				value, err := io.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				dbMu.Lock()
+				db[key] = string(value)
+				dbMu.Unlock()
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
 
 			v, err := gee.Get(key) // 进来之后都是用8003的gee去获取key的。
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 
 			w.Header().Set("Content-Type", "application/octet-stream")
-			w.Write(v.ByteSlice())
+			v.WriteTo(w) // 直接写出去，不用ByteSlice再拷贝一份
 		}))
 
 	log.Println("Api Server is running at", apiAddr)
-	log.Fatal(http.ListenAndServe(apiAddr[7:], nil))
+	u, err := url.Parse(apiAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Fatal(http.ListenAndServe(u.Host, nil))
+}
+
+// acl maps a bearer token to the permissions it grants on each group:
+// "r" to read, "w" to write, "rw" for both. A nil acl allows everything.
+type acl map[string]map[string]string
+
+// loadACL reads an acl from a JSON file such as
+//
+//	{"reader-token": {"scores": "r"}, "admin-token": {"scores": "rw"}}
+func loadACL(path string) (acl, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var a acl
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return a, nil
+}
+
+func (a acl) allows(r *http.Request, group string, perm byte) bool {
+	if a == nil {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	// 逐个常量时间比较，避免通过响应时间猜出token。
+	for t, groups := range a {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return strings.IndexByte(groups[group], perm) >= 0
+		}
+	}
+	return false
+}
+
+// signingKeys parses "id:secret,id2:secret2"; the first key signs requests.
+func signingKeys(s string) []geecache.SigningKey {
+	var keys []geecache.SigningKey
+	for _, kv := range strings.Split(s, ",") {
+		id, secret, ok := strings.Cut(kv, ":")
+		if !ok || id == "" || secret == "" {
+			log.Fatalf("bad signing key %q, want id:secret", kv)
+		}
+		keys = append(keys, geecache.SigningKey{ID: id, Secret: []byte(secret)})
+	}
+	return keys
 }
 
 // 运行一次main，开启一个geecache服务器
 func main() {
 	var port int
 	var api bool
+	var peerList, peerFile, gossipAddr, seeds, snapshotDir, codec string
+	var certFile, keyFile, caFile, peerKeys, tokenFile, logLevel string
+	var logSample uint64
 	flag.IntVar(&port, "port", 8001, "Geecache server port")
 	flag.BoolVar(&api, "api", false, "will launch apiServer?")
+	flag.StringVar(&peerList, "peers", "", "comma separated peer addresses (default localhost:8001 to 8003, over https with -tls-cert)")
+	flag.StringVar(&peerFile, "peers-file", "", "JSON or YAML file listing the peers, watched for changes")
+	flag.StringVar(&gossipAddr, "gossip", "", "UDP address for gossip membership, e.g. 127.0.0.1:7001")
+	flag.StringVar(&seeds, "seeds", "", "comma separated gossip addresses of existing members")
+	flag.StringVar(&snapshotDir, "snapshot-dir", "", "directory for periodic cache snapshots, restored on start")
+	flag.StringVar(&codec, "codec", "none", "codec for cached values: "+strings.Join(compress.Names(), ", "))
+	flag.StringVar(&certFile, "tls-cert", "", "certificate file; serves and dials peers over https")
+	flag.StringVar(&keyFile, "tls-key", "", "private key file of -tls-cert")
+	flag.StringVar(&caFile, "tls-ca", "", "CA file peers' certificates must be signed by; enables mutual TLS")
+	flag.StringVar(&peerKeys, "peer-keys", "", "comma separated id:secret keys peers sign their requests with; the first one signs")
+	flag.StringVar(&tokenFile, "api-tokens", "", "JSON file mapping API bearer tokens to per-group permissions")
+	flag.StringVar(&logLevel, "log-level", "warn", "cache and pool log level: debug, info, warn or error")
+	flag.Uint64Var(&logSample, "log-sample", 1, "log only one in this many debug records")
 	flag.Parse()
 
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		log.Fatal(err)
+	}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	handler = geecache.NewSamplingHandler(handler, slog.LevelInfo, logSample)
+	logger := slog.New(handler)
+
 	apiAddr := "http://localhost:9999"
-	addrMap := map[int]string{
-		8001: "http://localhost:8001",
-		8002: "http://localhost:8002",
-		8003: "http://localhost:8003",
+	scheme := "http"
+	poolOpts := []geecache.PoolOption{geecache.WithPoolLogger(logger)}
+	if certFile != "" {
+		scheme = "https"
+		poolOpts = append(poolOpts, tlsOptions(certFile, keyFile, caFile)...)
+	}
+	if peerKeys != "" {
+		poolOpts = append(poolOpts, geecache.WithSigning(signingKeys(peerKeys)...))
+	}
+	addr := fmt.Sprintf("%s://localhost:%d", scheme, port)
+
+	// 自己的地址和环上的地址要一字不差，否则找不到自己，每个key都会转发给自己。
+	if peerList == "" {
+		peerList = fmt.Sprintf("%[1]s://localhost:8001,%[1]s://localhost:8002,%[1]s://localhost:8003", scheme)
+	}
+	peers := strings.Split(peerList, ",")
+	for _, peer := range peers {
+		if !strings.HasPrefix(peer, scheme+"://") {
+			log.Fatalf("peer %s does not use %s like this node", peer, scheme)
+		}
 	}
 
-	var addrs []string
-	for _, v := range addrMap {
-		addrs = append(addrs, v)
+	var d discovery.Discovery = discovery.NewStatic(peers...)
+	if peerFile != "" {
+		f := discovery.NewFile(peerFile, 5*time.Second)
+		f.Logger = logger
+		d = f
+	}
+	if gossipAddr != "" { // 通过gossip协议自动发现其他节点，不再需要手动列出所有peer
+		t, err := membership.NewUDPTransport(gossipAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var seedList []string
+		if seeds != "" {
+			seedList = strings.Split(seeds, ",")
+		}
+		m, err := membership.New(membership.Config{Meta: addr, Seeds: seedList, Transport: t, Logger: logger})
+		if err != nil {
+			log.Fatal(err)
+		}
+		d = m
 	}
 
-	gee := createGroup()
+	opts := []geecache.GroupOption{geecache.WithLogger(logger)}
+	c, ok := compress.Lookup(codec)
+	if !ok {
+		log.Fatalf("unknown codec %q", codec)
+	}
+	opts = append(opts, geecache.WithCompression(c))
+	if snapshotDir != "" {
+		opts = append(opts, geecache.WithSnapshotDir(snapshotDir, time.Minute))
+	}
+	gee := createGroup(opts...)
 
 	if api {
-		go startApiServer(apiAddr, gee) // 负责接收http请求的，还是ApiServer。注意， apiserver依附于8003
+		var tokens acl
+		if tokenFile != "" {
+			var err error
+			if tokens, err = loadACL(tokenFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		go startApiServer(apiAddr, tokens) // 负责接收http请求的，还是ApiServer。注意， apiserver依附于8003
 	}
 
-	startCacheServer(addrMap[port], []string(addrs), gee)
+	startCacheServer(addr, d, gee, poolOpts...)
 }